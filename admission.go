@@ -0,0 +1,92 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// admission control of download requests
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// error codes of refused download requests, the central node may route
+// the board to another node at once
+const (
+	codeDraining  = 1001
+	codeQueueFull = 1002
+	codeDiskFull  = 1003
+	codeBusy      = 1004
+	codeNoSpace   = 1005
+	codeRunning   = 1006 // not an error, the job is accepted already
+)
+
+// admissionError tells why a job is refused and when to retry
+type admissionError struct {
+	code  int
+	msg   string
+	retry time.Duration
+}
+
+func (e *admissionError) Error() string {
+	return e.msg
+}
+
+// estimateSize returns the disk space a job needs, the board directory and
+// its archive both take about the size of all pins
+func estimateSize(data *download, pinKB uint) int64 {
+	n := len(data.downloads)
+	if maxs := int(data.MAXBoardNumber); n > maxs {
+		n = maxs
+	}
+	return int64(n) * averagePinSize(data.Site, pinKB) * 2
+}
+
+// admit checks whether a new job can be accepted now, nil means it is
+// accepted and registered as running
+func admit(data *download) *admissionError {
+	cfgMu.RLock()
+	refuse, maxJobs, pinKB := draining, jobLimit, pinSize
+	cfgMu.RUnlock()
+
+	// a retried request must not be refused for the space of its own job
+	if jobs.has(data.Uifn) {
+		return &admissionError{codeRunning, errJobRunning.Error(), 0}
+	}
+	if refuse {
+		return &admissionError{codeDraining, "service is draining", 10 * time.Minute}
+	}
+	dp, err := diskRate(dir)
+	if err != nil || dp > data.DiskLimit && !freeDisk(data.DiskLimit) {
+		return &admissionError{codeDiskFull, "disk usage is too high", 10 * time.Minute}
+	}
+	if systemBusy() {
+		return &admissionError{codeBusy, "system is busy", 30 * time.Second}
+	}
+	// the space reserved by running jobs is not free
+	need := estimateSize(data, pinKB)
+	free, err := ledger.available(data.DiskLimit)
+	if err == nil && need > free {
+		msg := fmt.Sprintf("not enough disk space, about %s is needed", formatSize(need))
+		return &admissionError{codeNoSpace, msg, 10 * time.Minute}
+	}
+	// the limit is checked at last, when the job takes its slot
+	if err := jobs.addIfBelow(data, int(maxJobs)); err == errJobRunning {
+		return &admissionError{codeRunning, err.Error(), 0}
+	} else if err != nil {
+		return &admissionError{codeQueueFull, err.Error(), time.Minute}
+	}
+	return nil
+}
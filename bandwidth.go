@@ -0,0 +1,129 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// bandwidth throttling of downloads and uploads
+
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bwChunk is the most bytes read or written at once by throttled streams
+const bwChunk = 32 << 10
+
+// node-wide limits of pin downloads and archive responses, the rates are
+// set by applyBandwidth
+var (
+	downloadBW = &bandwidth{}
+	uploadBW   = &bandwidth{}
+)
+
+// bandwidth is a token bucket of bytes, the burst is one second of rate
+type bandwidth struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 is unlimited
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidth(kbps uint) *bandwidth {
+	b := &bandwidth{}
+	b.setRate(kbps)
+	return b
+}
+
+func (b *bandwidth) setRate(kbps uint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(kbps) * 1024
+	b.tokens = b.rate
+	b.last = time.Now()
+}
+
+// wait blocks until n bytes are allowed, callers may run into debt which is
+// paid by sleeping
+func (b *bandwidth) wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(d)
+}
+
+// applyBandwidth sets the node-wide rates, the caller holds cfgMu
+func applyBandwidth() {
+	downloadBW.setRate(downloadLimit)
+	uploadBW.setRate(uploadLimit)
+}
+
+// limitedReader reads within all the bandwidth limits
+type limitedReader struct {
+	r   io.Reader
+	bws []*bandwidth
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bwChunk {
+		p = p[:bwChunk]
+	}
+	n, err := l.r.Read(p)
+	for _, b := range l.bws {
+		b.wait(n)
+	}
+	return n, err
+}
+
+// limitedWriter writes the response within all the bandwidth limits
+type limitedWriter struct {
+	http.ResponseWriter
+	bws []*bandwidth
+}
+
+func (l *limitedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > bwChunk {
+			chunk = chunk[:bwChunk]
+		}
+		for _, b := range l.bws {
+			b.wait(len(chunk))
+		}
+		m, err := l.ResponseWriter.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
@@ -0,0 +1,254 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// node-local content-addressed image cache
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.tcw.im/gtc"
+)
+
+// imgCache is nil if the cache is disabled
+var imgCache *cache
+
+// cache stores images by the sha256 of their content in objects/, and maps
+// the sha256 of urls to content hashes in urls/.
+// Cached objects are hard linked into board directories, this is safe as
+// files of boards are never modified in place, only replaced or removed.
+type cache struct {
+	mu    sync.Mutex
+	root  string
+	limit int64 // max bytes of objects
+	size  int64
+}
+
+func sha256Hex(text string) string {
+	h := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(h[:])
+}
+
+func newCache(root string, limit int64) (*cache, error) {
+	for _, sub := range []string{"objects", "urls"} {
+		if err := gtc.CreateDir(filepath.Join(root, sub)); err != nil {
+			return nil, err
+		}
+	}
+	// temp files of interrupted stores, those of another running process
+	// such as the server of a clean-once run are fresh
+	if tmps, err := filepath.Glob(filepath.Join(root, ".store-*")); err == nil {
+		for _, fn := range tmps {
+			if fi, err := os.Stat(fn); err == nil && time.Since(fi.ModTime()) > orphanGrace {
+				os.Remove(fn)
+			}
+		}
+	}
+	c := &cache{root: root, limit: limit}
+	for _, o := range c.objects() {
+		c.size += o.size
+	}
+	return c, nil
+}
+
+func (c *cache) objectPath(sum string) string {
+	return filepath.Join(c.root, "objects", sum[:2], sum)
+}
+
+func (c *cache) indexPath(url string) string {
+	h := sha256Hex(url)
+	return filepath.Join(c.root, "urls", h[:2], h)
+}
+
+// fetch links the cached image of url to dst, it reports whether it hits
+func (c *cache) fetch(url, dst string) bool {
+	obj, ok := c.lookup(url)
+	if !ok {
+		return false
+	}
+	// the lock is not held while copying, which may take a while if the
+	// cache is on another filesystem. An object evicted meanwhile is a miss.
+	if err := linkOrCopy(obj, dst); err != nil {
+		os.Remove(dst)
+		log.Printf("cache fetch failed: %s\n", err.Error())
+		return false
+	}
+	return true
+}
+
+// lookup returns the object of url, it is marked as used so that it is not
+// evicted soon
+func (c *cache) lookup(url string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	raw, err := os.ReadFile(c.indexPath(url))
+	if err != nil {
+		return "", false
+	}
+	sum := strings.TrimSpace(string(raw))
+	obj := c.objectPath(sum)
+	if len(sum) != sha256.Size*2 || !gtc.IsFile(obj) {
+		os.Remove(c.indexPath(url))
+		return "", false
+	}
+	// the modification time of an object is its last use
+	now := time.Now()
+	os.Chtimes(obj, now, now)
+	return obj, true
+}
+
+// store adds the downloaded file src of url to the cache, sum is the
+// sha256 of its content
+func (c *cache) store(url, src, sum string) {
+	obj := c.objectPath(sum)
+	// copy outside the lock into a temp file beside objects, it is moved
+	// in with the lock
+	var tmp string
+	if !gtc.IsFile(obj) {
+		tmp = filepath.Join(c.root, ".store-"+sum+"-"+genRandomString(8))
+		if err := linkOrCopy(src, tmp); err != nil {
+			os.Remove(tmp)
+			log.Printf("cache store failed: %s\n", err.Error())
+			return
+		}
+		defer os.Remove(tmp)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tmp != "" && !gtc.IsFile(obj) {
+		fi, err := os.Stat(tmp)
+		if err != nil {
+			return
+		}
+		if err := gtc.CreateDir(filepath.Dir(obj)); err != nil {
+			return
+		}
+		if err := os.Rename(tmp, obj); err != nil {
+			log.Printf("cache store failed: %s\n", err.Error())
+			return
+		}
+		c.size += fi.Size()
+	}
+	idx := c.indexPath(url)
+	if err := gtc.CreateDir(filepath.Dir(idx)); err != nil {
+		return
+	}
+	os.WriteFile(idx, []byte(sum), 0644)
+	if c.limit > 0 && c.size > c.limit {
+		c.evictLocked(c.size - c.limit)
+	}
+}
+
+type cacheObject struct {
+	path  string
+	size  int64
+	mtime time.Time
+}
+
+func (c *cache) objects() (objs []cacheObject) {
+	filepath.WalkDir(filepath.Join(c.root, "objects"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			objs = append(objs, cacheObject{p, fi.Size(), fi.ModTime()})
+		}
+		return nil
+	})
+	return
+}
+
+// evict removes the least recently used objects until need bytes are freed,
+// the freed bytes are returned
+func (c *cache) evict(need int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evictLocked(need)
+}
+
+// bytes returns the size of cached objects
+func (c *cache) bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *cache) evictLocked(need int64) (freed int64) {
+	objs := c.objects()
+	sort.Slice(objs, func(i, j int) bool { return objs[i].mtime.Before(objs[j].mtime) })
+	for _, o := range objs {
+		if freed >= need {
+			break
+		}
+		if os.Remove(o.path) == nil {
+			freed += o.size
+			c.size -= o.size
+		}
+	}
+	if freed > 0 {
+		log.Printf("cache evicted %s\n", formatSize(freed))
+	}
+	return
+}
+
+// freeDisk evicts cached images until the disk usage of dir is below limit,
+// it reports whether the usage is below limit afterwards
+func freeDisk(limit float64) bool {
+	need, err := diskOverBytes(dir, limit)
+	if err != nil {
+		return false
+	}
+	if need <= 0 {
+		return true
+	}
+	if imgCache == nil || imgCache.evict(need) == 0 {
+		return false
+	}
+	// objects still linked by boards do not release space
+	need, err = diskOverBytes(dir, limit)
+	return err == nil && need <= 0
+}
+
+// linkOrCopy hard links src to dst, or copies it if linking is not possible
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
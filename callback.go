@@ -0,0 +1,335 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// durable callback queue with retries
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.tcw.im/gtc"
+)
+
+const (
+	callbackMaxAttempts = 10
+	callbackBaseDelay   = 10 * time.Second
+	callbackMaxDelay    = time.Hour
+	// a claim older than this is left by a crashed sender
+	callbackClaimStale = 10 * time.Minute
+)
+
+// callbacks is the outbound callback queue, set up by handle
+var callbacks *callbackQueue
+
+type callback struct {
+	ID       string            `json:"id"`
+	URL      string            `json:"url"` // with Action query
+	Body     map[string]string `json:"body"`
+	Attempts int               `json:"attempts"`
+	NextTry  int64             `json:"next_try"`
+	Ctime    int64             `json:"ctime"`
+	LastErr  string            `json:"last_error,omitempty"`
+	JSON     bool              `json:"json,omitempty"` // post body as json
+}
+
+// callbackQueue persists callbacks as json files in pending/ until they are
+// delivered, callbacks that always fail are moved into dead/. A callback is
+// claimed by renaming its file before sending, so that it is sent once
+// though the queue is shared with other processes such as clean-once.
+type callbackQueue struct {
+	mu       sync.Mutex
+	root     string
+	notify   chan struct{}
+	enqueued map[string]bool // ids of callbacks enqueued by this process
+}
+
+func callbackDir() string {
+	return filepath.Join(dir, ".callbacks")
+}
+
+func newCallbackQueue(root string) (*callbackQueue, error) {
+	for _, sub := range []string{"pending", "dead"} {
+		if err := gtc.CreateDir(filepath.Join(root, sub)); err != nil {
+			return nil, err
+		}
+	}
+	q := &callbackQueue{root: root, notify: make(chan struct{}, 1), enqueued: make(map[string]bool)}
+	return q, nil
+}
+
+func (q *callbackQueue) path(state, id string) string {
+	return filepath.Join(q.root, state, filepath.Base(id)+".json")
+}
+
+func (q *callbackQueue) claimPath(id string) string {
+	return q.path("pending", id) + ".sending"
+}
+
+// claim takes the pending callback to send, false if it is taken by another
+// sender or already sent
+func (q *callbackQueue) claim(cb *callback) bool {
+	// the claim is touched first, or it may look stale at once
+	now := time.Now()
+	fn := q.path("pending", cb.ID)
+	if os.Chtimes(fn, now, now) != nil {
+		return false
+	}
+	return os.Rename(fn, q.claimPath(cb.ID)) == nil
+}
+
+// unclaimStale gives back the claims of crashed senders
+func (q *callbackQueue) unclaimStale() {
+	dfs, err := os.ReadDir(filepath.Join(q.root, "pending"))
+	if err != nil {
+		return
+	}
+	for _, f := range dfs {
+		if !strings.HasSuffix(f.Name(), ".json.sending") {
+			continue
+		}
+		fi, err := f.Info()
+		if err != nil || time.Since(fi.ModTime()) < callbackClaimStale {
+			continue
+		}
+		fn := filepath.Join(q.root, "pending", f.Name())
+		os.Rename(fn, strings.TrimSuffix(fn, ".sending"))
+	}
+}
+
+func (q *callbackQueue) save(state string, cb *callback) error {
+	raw, err := json.Marshal(cb)
+	if err != nil {
+		return err
+	}
+	fn := q.path(state, cb.ID)
+	if err := os.WriteFile(fn+".tmp", raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+// enqueue persists a callback to url with action, it is sent in background,
+// the body is posted as json instead of form if asJSON is true
+func (q *callbackQueue) enqueue(url, action string, body map[string]string, asJSON bool) error {
+	now := nowTimestamp()
+	cb := &callback{
+		ID:      fmt.Sprintf("%d-%s", time.Now().UnixNano(), genRandomString(8)),
+		URL:     fmt.Sprintf("%s?Action=%s", url, action),
+		Body:    body,
+		NextTry: now,
+		Ctime:   now,
+		JSON:    asJSON,
+	}
+	q.mu.Lock()
+	err := q.save("pending", cb)
+	if err == nil {
+		q.enqueued[cb.ID] = true
+	}
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// list returns callbacks of state (pending or dead) sorted by creation
+func (q *callbackQueue) list(state string) ([]*callback, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.listLocked(state)
+}
+
+func (q *callbackQueue) listLocked(state string) ([]*callback, error) {
+	dfs, err := os.ReadDir(filepath.Join(q.root, state))
+	if err != nil {
+		return nil, err
+	}
+	cbs := make([]*callback, 0, len(dfs))
+	for _, f := range dfs {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(q.root, state, f.Name()))
+		if err != nil {
+			continue
+		}
+		cb := &callback{}
+		if err := json.Unmarshal(raw, cb); err != nil {
+			log.Printf("invalid callback %s: %s\n", f.Name(), err.Error())
+			continue
+		}
+		cbs = append(cbs, cb)
+	}
+	sort.Slice(cbs, func(i, j int) bool { return cbs[i].ID < cbs[j].ID })
+	return cbs, nil
+}
+
+// send posts the callback once, non-2xx responses are failures
+func (cb *callback) send() error {
+	resp, err := httpPost(cb.URL, cb.Body, cb.JSON)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	text, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("callback response %s", resp.Status)
+	}
+	log.Printf("Callback %s for %s, resp is %s\n", cb.URL, cb.Body["uifn"], string(text))
+	return nil
+}
+
+// backoff returns the delay before the next attempt, it doubles each time
+func backoff(attempts int) time.Duration {
+	d := callbackBaseDelay
+	for i := 1; i < attempts && d < callbackMaxDelay; i++ {
+		d *= 2
+	}
+	if d > callbackMaxDelay {
+		d = callbackMaxDelay
+	}
+	return d
+}
+
+// flush tries to send all due callbacks once
+func (q *callbackQueue) flush() {
+	q.sendDue(nil, time.Time{})
+}
+
+// flushUntil is flush, but no callback is sent after deadline, the rest
+// are left pending
+func (q *callbackQueue) flushUntil(deadline time.Time) {
+	q.sendDue(nil, deadline)
+}
+
+// flushEnqueued tries to send the due callbacks enqueued by this process
+// once, those of other processes are left to them
+func (q *callbackQueue) flushEnqueued() {
+	q.mu.Lock()
+	ids := make(map[string]bool, len(q.enqueued))
+	for id := range q.enqueued {
+		ids[id] = true
+	}
+	q.mu.Unlock()
+	q.sendDue(ids, time.Time{})
+}
+
+// sendDue sends the due callbacks of ids, all if ids is nil, until deadline
+// if it is not zero
+func (q *callbackQueue) sendDue(ids map[string]bool, deadline time.Time) {
+	q.mu.Lock()
+	q.unclaimStale()
+	cbs, err := q.listLocked("pending")
+	q.mu.Unlock()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	now := nowTimestamp()
+	for _, cb := range cbs {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return
+		}
+		if cb.NextTry > now || ids != nil && !ids[cb.ID] || !q.claim(cb) {
+			continue
+		}
+		// the lock is not held while sending, which may take a while
+		err := cb.send()
+		q.mu.Lock()
+		q.update(cb, err)
+		q.mu.Unlock()
+	}
+}
+
+// update records the result of an attempt of the claimed callback
+func (q *callbackQueue) update(cb *callback, err error) {
+	defer os.Remove(q.claimPath(cb.ID))
+	if err == nil {
+		delete(q.enqueued, cb.ID)
+		return
+	}
+	cb.Attempts++
+	cb.LastErr = err.Error()
+	cb.NextTry = nowTimestamp() + int64(backoff(cb.Attempts).Seconds())
+	if cb.Attempts >= callbackMaxAttempts {
+		log.Printf("callback %s is dead after %d attempts: %s\n", cb.ID, cb.Attempts, cb.LastErr)
+		delete(q.enqueued, cb.ID)
+		if err := q.save("dead", cb); err != nil {
+			// keep it pending rather than losing it
+			q.save("pending", cb)
+		}
+		return
+	}
+	log.Printf("callback %s failed, retry in %s: %s\n", cb.ID, backoff(cb.Attempts), cb.LastErr)
+	q.save("pending", cb)
+}
+
+// run delivers callbacks in background until the process exits
+func (q *callbackQueue) run() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		q.flush()
+		select {
+		case <-ticker.C:
+		case <-q.notify:
+		}
+	}
+}
+
+// replay moves the dead callback of id (all if id is empty) back to pending,
+// the number of replayed callbacks is returned
+func (q *callbackQueue) replay(id string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cbs, err := q.listLocked("dead")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, cb := range cbs {
+		if id != "" && cb.ID != id {
+			continue
+		}
+		cb.Attempts = 0
+		cb.NextTry = nowTimestamp()
+		if err := q.save("pending", cb); err != nil {
+			return n, err
+		}
+		os.Remove(q.path("dead", cb.ID))
+		n++
+	}
+	if n > 0 {
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,430 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// clean download in cli and background
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"pkg.tcw.im/gtc"
+)
+
+// sitePrefixes are the archive name prefixes of supported sites
+var sitePrefixes = []string{"hb", "dt"}
+
+// orphanGrace is the age after which leftovers of no running job are removed
+const orphanGrace = time.Hour
+
+// cleanItem is a removed archive, board directory or serialization file
+type cleanItem struct {
+	Kind   string `json:"kind"` // archive, board, seria or part
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"` // expired, quota, orphan or nometa
+	Notify bool   `json:"notify"` // whether SECOND_STATUS is sent
+}
+
+// parseUifn returns the site prefix and the millisecond timestamp of an
+// archive name, such as hb_1609430400000.tar
+func parseUifn(n string) (aid string, mst int, ok bool) {
+	if path.Ext(n) != ".tar" {
+		return
+	}
+	ns := strings.Split(strings.TrimSuffix(n, path.Ext(n)), "_")
+	if len(ns) < 2 {
+		return
+	}
+	mst, err := strconv.Atoi(ns[1])
+	if err != nil {
+		return
+	}
+	aid = ns[0]
+	if !gtc.StrInSlice(aid, sitePrefixes) {
+		return
+	}
+	return aid, mst, true
+}
+
+// expireArchive queues the expired status report of an archive and deletes
+// it, archives without serialization data are deleted without report.
+// In dry run mode, it only tells whether the report would be sent.
+func expireArchive(n string) (notified bool, err error) {
+	var data clean
+	if dryrun {
+		return deserialize(&data, n) == nil, nil
+	}
+	if deserialize(&data, n) == nil {
+		body := make(map[string]string)
+		body["uifn"] = data.Uifn
+		if err := callbacks.enqueue(data.CallbackURL, actionExpired, body, data.JSON); err != nil {
+			return false, err
+		}
+		rmserialize(n)
+		notified = true
+	}
+	return notified, archives.Delete(n)
+}
+
+// perform a cleanup, the removed items are returned
+func cleanDownload(hours int) (report []cleanItem) {
+	dfs, err := archives.List()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, f := range dfs {
+		// n is Uifn
+		n := f.Name
+		_, mst, ok := parseUifn(n)
+		if !ok {
+			continue
+		}
+		// checked pass, enter the processing flow
+		if expireTime(f, mst, hours) <= nowTimestamp() {
+			// expired, clean and report
+			notified, err := expireArchive(n)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			reason := "expired"
+			if !notified {
+				reason = "nometa"
+			}
+			report = append(report, cleanItem{"archive", n, f.Size, reason, notified})
+		}
+	}
+	report = append(report, evictArchives(report)...)
+	report = append(report, cleanOrphans()...)
+	if !dryrun {
+		for _, item := range report {
+			log.Printf("clean %s %s (%s), %s\n", item.Kind, item.Name, item.Reason, formatSize(item.Size))
+		}
+	}
+	return
+}
+
+// printReport writes the clean report to stdout as a table or json
+func printReport(report []cleanItem, format string) error {
+	if format == "json" {
+		if report == nil {
+			report = []cleanItem{}
+		}
+		raw, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(raw))
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAME\tSIZE\tREASON\tSECOND_STATUS")
+	var total int64
+	for _, item := range report {
+		total += item.Size
+		notify := "no"
+		if item.Notify {
+			notify = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", item.Kind, item.Name, formatSize(item.Size), item.Reason, notify)
+	}
+	tw.Flush()
+	verb := "Removed"
+	if dryrun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d items, %s in total\n", verb, len(report), formatSize(total))
+	return nil
+}
+
+// archiveEtime returns the expiration time of the job, 0 if unknown
+func archiveEtime(n string) int64 {
+	var data clean
+	if err := deserialize(&data, n); err != nil {
+		return 0
+	}
+	return data.Etime
+}
+
+// expireTime returns when the archive expires, it is the etime of its job
+// if recorded, otherwise hours after it is made
+func expireTime(f storageInfo, mst int, hours int) int64 {
+	if etime := archiveEtime(f.Name); etime > 0 {
+		return etime
+	}
+	ltime := int64(60 * 60 * hours)
+	ctime := int64(mst/1000) + ltime
+	fctime := f.ModTime.Unix() + ltime
+	if fctime > ctime {
+		return fctime
+	}
+	return ctime
+}
+
+// touchArchive records the time the archive is downloaded by user
+func touchArchive(n string) {
+	var data clean
+	if err := deserialize(&data, n); err != nil {
+		return
+	}
+	data.Atime = nowTimestamp()
+	serialize(data, n)
+	if data.Events {
+		body := map[string]string{"uifn": data.Uifn, "uifnKey": data.UifnKey}
+		if err := callbacks.enqueue(data.CallbackURL, actionDownloaded, body, data.JSON); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// lastUse returns when the archive was last downloaded by user,
+// or when it was made if it has never been downloaded
+func lastUse(f storageInfo) int64 {
+	var data clean
+	if err := deserialize(&data, f.Name); err == nil && data.Atime > f.ModTime.Unix() {
+		return data.Atime
+	}
+	return f.ModTime.Unix()
+}
+
+// quotaOverBytes returns how many bytes of archives exceed the quota
+func quotaOverBytes(infos []storageInfo) (need int64) {
+	var total int64
+	for _, f := range infos {
+		total += f.Size
+	}
+	cfgMu.RLock()
+	maxSize, maxPercent := quota, quotaPercent
+	cfgMu.RUnlock()
+	if maxSize > 0 {
+		need = total - int64(maxSize)<<20
+	}
+	if maxPercent > 0 && isLocalStorage() {
+		// cached images can be thrown away, they go before archives
+		if !dryrun {
+			freeDisk(maxPercent)
+		}
+		over, err := diskOverBytes(dir, maxPercent)
+		if err == nil && dryrun && imgCache != nil {
+			over -= imgCache.bytes()
+		}
+		if err == nil && over > need {
+			need = over
+		}
+	}
+	return
+}
+
+// evictArchives expires the least recently used archives until the total
+// size is under quota, even if they have not reached the clean hour.
+// Archives in removed are already cleaned (or would be in dry run mode).
+func evictArchives(removed []cleanItem) (report []cleanItem) {
+	cfgMu.RLock()
+	unlimited := quota == 0 && quotaPercent <= 0
+	cfgMu.RUnlock()
+	if unlimited {
+		return
+	}
+	dfs, err := archives.List()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	skip := make(map[string]bool)
+	for _, item := range removed {
+		skip[item.Name] = true
+	}
+	var infos []storageInfo
+	for _, f := range dfs {
+		if _, _, ok := parseUifn(f.Name); ok && !jobs.has(f.Name) && !skip[f.Name] {
+			infos = append(infos, f)
+		}
+	}
+	need := quotaOverBytes(infos)
+	if need <= 0 {
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool { return lastUse(infos[i]) < lastUse(infos[j]) })
+	var freed int64
+	for _, f := range infos {
+		if freed >= need {
+			break
+		}
+		notified, err := expireArchive(f.Name)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		freed += f.Size
+		report = append(report, cleanItem{"archive", f.Name, f.Size, "quota", notified})
+	}
+	return
+}
+
+// dirSize returns the total size of regular files in a directory
+func dirSize(root string) (size int64) {
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// cleanOrphans removes board directories left by crashed jobs and
+// serialization files whose archive no longer exists
+func cleanOrphans() []cleanItem {
+	deadline := time.Now().Add(-orphanGrace)
+	// jobs running in another process, or suspended by shutdown to resume,
+	// keep their files
+	boards, uifns := diskJobs()
+	report := append(cleanOrphanBoards(deadline, boards), cleanOrphanSeria(deadline, uifns)...)
+	return append(report, cleanOrphanParts(deadline, uifns)...)
+}
+
+func cleanOrphanBoards(deadline time.Time, live map[string]bool) (report []cleanItem) {
+	dfs, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// directories of tdi itself are not boards whatever their names, nor
+	// are those holding them
+	var reserved []string
+	for _, d := range []string{cacheDir, checkpointDir(), callbackDir()} {
+		if abs, err := filepath.Abs(d); err == nil && d != "" {
+			reserved = append(reserved, abs)
+		}
+	}
+	for _, f := range dfs {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") || jobs.hasBoard(f.Name()) || live[f.Name()] {
+			continue
+		}
+		bdir := filepath.Join(dir, f.Name())
+		if holdsAny(bdir, reserved) {
+			continue
+		}
+		fi, err := f.Info()
+		if err != nil || fi.ModTime().After(deadline) {
+			continue
+		}
+		size := dirSize(bdir)
+		if dryrun {
+			report = append(report, cleanItem{"board", f.Name(), size, "orphan", false})
+			continue
+		}
+		if err := os.RemoveAll(bdir); err != nil {
+			log.Println(err)
+			continue
+		}
+		report = append(report, cleanItem{"board", f.Name(), size, "orphan", false})
+	}
+	return
+}
+
+// holdsAny reports whether any of the absolute paths is d or under d
+func holdsAny(d string, paths []string) bool {
+	abs, err := filepath.Abs(d)
+	if err != nil {
+		return true
+	}
+	for _, p := range paths {
+		if rel, err := filepath.Rel(abs, p); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanOrphanSeria(deadline time.Time, live map[string]bool) (report []cleanItem) {
+	dfs, err := os.ReadDir(filepath.Dir(seriaName("tdi")))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, f := range dfs {
+		name := f.Name()
+		if !f.Type().IsRegular() || !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".dat") {
+			continue
+		}
+		n := strings.TrimSuffix(strings.TrimPrefix(name, "."), ".dat")
+		if _, _, ok := parseUifn(n); !ok || jobs.has(n) || live[n] {
+			continue
+		}
+		fi, err := f.Info()
+		if err != nil || fi.ModTime().After(deadline) {
+			continue
+		}
+		if _, err := archives.Stat(n); err != errNotFound {
+			continue
+		}
+		if dryrun {
+			report = append(report, cleanItem{"seria", name, fi.Size(), "orphan", false})
+			continue
+		}
+		if err := rmserialize(n); err != nil {
+			log.Println(err)
+			continue
+		}
+		report = append(report, cleanItem{"seria", name, fi.Size(), "orphan", false})
+	}
+	return
+}
+
+// cleanOrphanParts removes part files of archives left by killed jobs
+func cleanOrphanParts(deadline time.Time, live map[string]bool) (report []cleanItem) {
+	dfs, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, f := range dfs {
+		n, ok := strings.CutSuffix(f.Name(), ".part")
+		if !ok || !f.Type().IsRegular() {
+			continue
+		}
+		if _, _, ok := parseUifn(n); !ok || jobs.has(n) || live[n] {
+			continue
+		}
+		fi, err := f.Info()
+		if err != nil || fi.ModTime().After(deadline) {
+			continue
+		}
+		if !dryrun {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				log.Println(err)
+				continue
+			}
+		}
+		report = append(report, cleanItem{"part", f.Name(), fi.Size(), "orphan", false})
+	}
+	return
+}
@@ -0,0 +1,265 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// load and validate settings from flag, env and config file
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"pkg.tcw.im/gtc"
+)
+
+// configKeys are the flag names that can also be set by env and config file,
+// the precedence is flag > env > config file > default
+var configKeys = []string{
+	"host", "port", "dir", "token", "status", "hour", "noclean", "grace",
+	"concurrency", "timeout", "callback-timeout", "user-agent",
+	"huaban-referer", "duitang-referer",
+	"huaban-rate", "huaban-conns", "duitang-rate", "duitang-conns",
+	"proxy", "huaban-proxy", "duitang-proxy",
+	"download-limit", "job-download-limit", "upload-limit", "conn-upload-limit",
+	"max-jobs", "pin-size", "mem-limit", "load-limit", "cache-dir", "cache-limit",
+	"quota", "quota-percent",
+	"storage", "s3-endpoint", "s3-region", "s3-bucket", "s3-prefix", "s3-path-style",
+}
+
+// secretKeys have no flag, they are set by env and config file only
+var secretKeys = map[string]*string{
+	"s3-access-key": &s3cfg.AccessKey,
+	"s3-secret-key": &s3cfg.SecretKey,
+}
+
+// flagAliases are the short flags of config keys
+var flagAliases = map[string]string{"d": "dir", "t": "token", "s": "status"}
+
+// envName returns the env of a config key, such as tdi_mem_limit
+func envName(key string) string {
+	return "tdi_" + strings.ReplaceAll(key, "-", "_")
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// loadConfig sets the config keys not given by flag from env or config file,
+// all errors are returned
+func loadConfig() (errs []error) {
+	if configFile == "" {
+		configFile = os.Getenv("tdi_config")
+	}
+	file, errs := configFileValues()
+	errs = append(errs, setConfig(configKeys, file)...)
+	for k, p := range secretKeys {
+		if v := os.Getenv(envName(k)); v != "" {
+			*p = v
+		} else {
+			*p = file[k]
+		}
+	}
+	return
+}
+
+// configFileValues reads the config file if any, unknown keys are errors
+func configFileValues() (file map[string]string, errs []error) {
+	file = make(map[string]string)
+	if configFile != "" {
+		var err error
+		file, err = readConfig(configFile)
+		if err != nil {
+			return make(map[string]string), []error{err}
+		}
+	}
+	keys := make([]string, 0, len(file))
+	for k := range file {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !gtc.StrInSlice(k, configKeys) && secretKeys[k] == nil {
+			errs = append(errs, fmt.Errorf("unknown config %s", k))
+		}
+	}
+	return
+}
+
+// setConfig sets keys not given by flag from env or config file, the others
+// are reset to default
+func setConfig(keys []string, file map[string]string) (errs []error) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		if long, ok := flagAliases[f.Name]; ok {
+			set[long] = true
+		}
+		set[f.Name] = true
+	})
+	for _, k := range keys {
+		if set[k] {
+			continue
+		}
+		f := flag.Lookup(k)
+		if v := os.Getenv(envName(k)); v != "" {
+			if isBoolFlag(f) {
+				v = strconv.FormatBool(gtc.IsTrue(v))
+			}
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid env %s: %s", envName(k), v))
+			}
+		} else if v, ok := file[k]; ok {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid config %s: %s", k, v))
+			}
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+	}
+	return
+}
+
+// normalizeConfig fills the settings whose zero value means auto
+func normalizeConfig() {
+	if loadLimit <= 0 {
+		loadLimit = float64(runtime.NumCPU())
+	}
+}
+
+// readConfig reads a yaml or toml config file, nested sections are joined
+// into flat keys, such as s3.bucket to s3-bucket
+func readConfig(fn string) (map[string]string, error) {
+	raw, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &tree)
+	case ".toml":
+		err = toml.Unmarshal(raw, &tree)
+	default:
+		return nil, errors.New("config file needs to be .yaml, .yml or .toml")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %s", fn, err.Error())
+	}
+	file := make(map[string]string)
+	return file, flattenConfig("", tree, file)
+}
+
+func flattenConfig(prefix string, tree map[string]interface{}, file map[string]string) error {
+	for k, v := range tree {
+		key := strings.ReplaceAll(strings.ToLower(k), "_", "-")
+		if prefix != "" {
+			key = prefix + "-" + key
+		}
+		switch v := v.(type) {
+		case nil:
+		case map[string]interface{}:
+			if err := flattenConfig(key, v, file); err != nil {
+				return err
+			}
+		case []interface{}:
+			// a list of values, such as proxies, is comma separated
+			items := make([]string, len(v))
+			for i, item := range v {
+				switch item.(type) {
+				case map[string]interface{}, []interface{}:
+					return fmt.Errorf("invalid config %s: list of tables is not supported", key)
+				}
+				items[i] = fmt.Sprint(item)
+			}
+			file[key] = strings.Join(items, ",")
+		case []map[string]interface{}:
+			return fmt.Errorf("invalid config %s: list of tables is not supported", key)
+		default:
+			file[key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// validateConfig checks the settings, all errors are returned
+func validateConfig() (errs []error) {
+	if port < 1 || port > 65535 {
+		errs = append(errs, errors.New("port needs to be between 1 and 65535"))
+	}
+	if hour <= 0 {
+		errs = append(errs, errors.New("hour needs to be greater than 0"))
+	}
+	if status != "ready" && status != "tardy" {
+		errs = append(errs, errors.New("status needs to be ready or tardy"))
+	}
+	if report != "table" && report != "json" {
+		errs = append(errs, errors.New("report needs to be table or json"))
+	}
+	if dryrun && !cleanonce {
+		errs = append(errs, errors.New("dry-run is only used with clean-once"))
+	}
+	if timeout <= 0 {
+		errs = append(errs, errors.New("timeout needs to be greater than 0"))
+	}
+	if callbackTimeout <= 0 {
+		errs = append(errs, errors.New("callback-timeout needs to be greater than 0"))
+	}
+	if strings.Count(huabanReferer, "%s") != 1 {
+		errs = append(errs, errors.New("huaban-referer needs one %s of board id"))
+	}
+	if strings.Count(duitangReferer, "%s") != 1 {
+		errs = append(errs, errors.New("duitang-referer needs one %s of board id"))
+	}
+	if huabanRate <= 0 || duitangRate <= 0 {
+		errs = append(errs, errors.New("huaban-rate and duitang-rate need to be greater than 0"))
+	}
+	if huabanConns == 0 || duitangConns == 0 {
+		errs = append(errs, errors.New("huaban-conns and duitang-conns need to be greater than 0"))
+	}
+	for _, list := range []string{proxyList, huabanProxy, duitangProxy} {
+		if _, err := newProxyPool(list); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if memLimit <= 0 || memLimit > 100 {
+		errs = append(errs, errors.New("mem-limit needs to be between 0 and 100"))
+	}
+	if loadLimit < 0 {
+		errs = append(errs, errors.New("load-limit needs to be positive"))
+	}
+	if quotaPercent < 0 || quotaPercent >= 100 {
+		errs = append(errs, errors.New("quota-percent needs to be between 0 and 100"))
+	}
+	switch storageType {
+	case "", "local":
+	case "s3":
+		c := s3cfg
+		if _, err := newS3Storage(&c); err != nil {
+			errs = append(errs, fmt.Errorf("invalid s3 storage: %s", err.Error()))
+		}
+	default:
+		errs = append(errs, errors.New("storage needs to be local or s3"))
+	}
+	return
+}
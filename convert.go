@@ -0,0 +1,128 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// convert non-universal image formats to jpeg or png
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"pkg.tcw.im/gtc"
+)
+
+const originalDir = "originals"
+
+// universalFormats can be opened by almost every viewer, others are converted
+var universalFormats = []string{"jpeg", "png", "gif"}
+
+// convertTarget normalizes the requested target format,
+// an empty string means no conversion
+func convertTarget(target string) (string, error) {
+	switch strings.ToLower(target) {
+	case "":
+		return "", nil
+	case "jpeg", "jpg":
+		return "jpeg", nil
+	case "png":
+		return "png", nil
+	}
+	return "", errors.New("invalid convert format")
+}
+
+// convertImage transcodes the file in bdir into target format, the name of
+// the new file is returned
+func convertImage(bdir, name, target string) (string, error) {
+	img, err := decodeImage(filepath.Join(bdir, name))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			err = errors.New("unsupported format")
+		}
+		return "", err
+	}
+	newName := uniqueName(bdir, strings.TrimSuffix(name, path.Ext(name)), formatExt[target])
+	newFile := filepath.Join(bdir, newName)
+	f, err := os.Create(newFile)
+	if err != nil {
+		return "", err
+	}
+	if target == "png" {
+		err = png.Encode(f, img)
+	} else {
+		err = jpeg.Encode(f, flatten(img), &jpeg.Options{Quality: 92})
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(newFile)
+		return "", err
+	}
+	return newName, nil
+}
+
+// convertImages transcodes non-universal images of the manifest into target
+// format, the originals are moved into the originals folder if keep is true,
+// otherwise they are removed.
+func convertImages(bdir string, m *manifest, target string, keep bool, readme *strbuilder) {
+	if keep {
+		if err := gtc.CreateDir(filepath.Join(bdir, originalDir)); err != nil {
+			readme.WriteE(err)
+			return
+		}
+	}
+	for i := range m.Files {
+		e := &m.Files[i]
+		if e.Format == "" || gtc.StrInSlice(e.Format, universalFormats) {
+			continue
+		}
+		if !waitIdle() {
+			readme.WriteS("system is busy, image conversion aborted")
+			return
+		}
+		newName, err := convertImage(bdir, e.File, target)
+		if err != nil {
+			readme.WriteS(fmt.Sprintf("convert %s: %s", e.File, err.Error()))
+			continue
+		}
+		src := filepath.Join(bdir, e.File)
+		if keep {
+			e.Original = path.Join(originalDir, e.File)
+			err = os.Rename(src, filepath.Join(bdir, e.Original))
+		} else {
+			err = os.Remove(src)
+		}
+		if err != nil {
+			readme.WriteE(err)
+		}
+		if fi, err := os.Stat(filepath.Join(bdir, newName)); err == nil {
+			e.Size = fi.Size()
+		}
+		e.From = e.Format
+		e.Format = target
+		e.File = newName
+	}
+}
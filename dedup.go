@@ -0,0 +1,178 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// perceptual duplicate detection within a board
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pkg.tcw.im/gtc"
+)
+
+const (
+	duplicateDir  = "duplicates"
+	hashThreshold = 5 // max hamming distance of similar images
+	// max relative difference of aspect ratios of similar images, re-pins
+	// at another resolution keep the ratio
+	aspectTolerance = 0.03
+)
+
+// dedupMode normalizes the requested mode: drop, group or empty(off)
+func dedupMode(mode string) (string, error) {
+	mode = strings.ToLower(mode)
+	switch mode {
+	case "", "drop", "group":
+		return mode, nil
+	}
+	return "", errors.New("invalid dedup mode")
+}
+
+// dHash computes the 64 bits difference hash of an image, which compares
+// the brightness of adjacent pixels in a 9x8 grayscale thumbnail
+func dHash(img image.Image) uint64 {
+	src := flatten(img)
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	const w, h = 9, 8
+	var gray [h][w]float64
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+			var sum float64
+			for sy := y0; sy < y1 && sy < sh; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1 && sx < sw; sx++ {
+					p := src.Pix[i : i+3]
+					sum += 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+					i += 4
+				}
+			}
+			gray[y][x] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if gray[y][x] < gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+type hashedImage struct {
+	index  int // index in manifest files
+	hash   uint64
+	width  int
+	height int
+}
+
+func (h hashedImage) pixels() int {
+	return h.width * h.height
+}
+
+// similar reports whether two images look the same, their hashes are close
+// and their aspect ratios are nearly equal
+func similar(a, b hashedImage) bool {
+	if bits.OnesCount64(a.hash^b.hash) > hashThreshold || a.height == 0 || b.height == 0 {
+		return false
+	}
+	ra := float64(a.width) / float64(a.height)
+	rb := float64(b.width) / float64(b.height)
+	return math.Abs(ra-rb) <= aspectTolerance*math.Max(ra, rb)
+}
+
+// dedupImages finds images that look the same and keeps the one with the
+// highest resolution, the others are removed (drop) or moved into the
+// duplicates folder (group). Decisions are written to readme.
+func dedupImages(bdir string, m *manifest, mode string, readme *strbuilder) {
+	var hashed []hashedImage
+	for i, e := range m.Files {
+		if !waitIdle() {
+			readme.WriteS("system is busy, duplicate detection aborted")
+			return
+		}
+		img, err := decodeImage(filepath.Join(bdir, e.File))
+		if err != nil {
+			continue
+		}
+		b := img.Bounds()
+		hashed = append(hashed, hashedImage{i, dHash(img), b.Dx(), b.Dy()})
+	}
+	// the larger one is compared first and becomes the one to keep
+	sort.SliceStable(hashed, func(i, j int) bool {
+		if hashed[i].pixels() != hashed[j].pixels() {
+			return hashed[i].pixels() > hashed[j].pixels()
+		}
+		return m.Files[hashed[i].index].Size > m.Files[hashed[j].index].Size
+	})
+	if mode == "group" {
+		if err := gtc.CreateDir(filepath.Join(bdir, duplicateDir)); err != nil {
+			readme.WriteE(err)
+			return
+		}
+	}
+	var kept []hashedImage
+	for _, hi := range hashed {
+		var orig *hashedImage
+		for k := range kept {
+			if similar(hi, kept[k]) {
+				orig = &kept[k]
+				break
+			}
+		}
+		if orig == nil {
+			kept = append(kept, hi)
+			continue
+		}
+		e := &m.Files[hi.index]
+		src := filepath.Join(bdir, e.File)
+		var err error
+		if mode == "drop" {
+			err = os.Remove(src)
+		} else {
+			moved := path.Join(duplicateDir, e.File)
+			if err = os.Rename(src, filepath.Join(bdir, moved)); err == nil {
+				e.File = moved
+			}
+		}
+		if err != nil {
+			readme.WriteS(fmt.Sprintf("duplicate %s: %s", e.File, err.Error()))
+			continue
+		}
+		e.Duplicate = m.Files[orig.index].File
+		e.Dropped = mode == "drop"
+		readme.WriteS(fmt.Sprintf("duplicate %s of %s, %s", e.Name, e.Duplicate, mode))
+	}
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// tests of perceptual duplicate detection
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pkg.tcw.im/gtc"
+)
+
+// gradient returns an image getting brighter from left to right, or from
+// right to left if reverse
+func gradient(w, h int, reverse bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		v := uint8(x * 255 / (w - 1))
+		if reverse {
+			v = 255 - v
+		}
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	a := dHash(gradient(80, 60, false))
+	if b := dHash(gradient(400, 300, false)); bits.OnesCount64(a^b) > hashThreshold {
+		t.Errorf("resized image distance = %d", bits.OnesCount64(a^b))
+	}
+	if b := dHash(gradient(80, 60, true)); bits.OnesCount64(a^b) <= hashThreshold {
+		t.Errorf("reversed image distance = %d", bits.OnesCount64(a^b))
+	}
+	flat := image.NewRGBA(image.Rect(0, 0, 30, 30))
+	if h := dHash(flat); h != 0 {
+		t.Errorf("flat image hash = %x, want 0", h)
+	}
+}
+
+func TestSimilar(t *testing.T) {
+	h := dHash(gradient(80, 60, false))
+	tests := []struct {
+		name string
+		a, b hashedImage
+		want bool
+	}{
+		{"same ratio", hashedImage{0, h, 400, 300}, hashedImage{1, h, 800, 600}, true},
+		{"ratio rounded", hashedImage{0, h, 400, 300}, hashedImage{1, h, 401, 299}, true},
+		{"other ratio", hashedImage{0, h, 400, 300}, hashedImage{1, h, 50, 500}, false},
+		{"cropped", hashedImage{0, h, 400, 300}, hashedImage{1, h, 400, 260}, false},
+		{"other hash", hashedImage{0, h, 400, 300}, hashedImage{1, ^h, 400, 300}, false},
+	}
+	for _, tt := range tests {
+		if got := similar(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: similar = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// dedupBoard writes the images into a board directory and runs dedupImages
+func dedupBoard(t *testing.T, mode string, images map[string]image.Image) (string, *manifest) {
+	// waitIdle must not take the test machine as busy
+	oldMem, oldLoad := memLimit, loadLimit
+	memLimit, loadLimit = 100, 1e9
+	t.Cleanup(func() { memLimit, loadLimit = oldMem, oldLoad })
+
+	bdir := t.TempDir()
+	m := &manifest{}
+	for _, name := range []string{"small.png", "large.png", "tall.png"} {
+		f, err := os.Create(filepath.Join(bdir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		png.Encode(f, images[name])
+		f.Close()
+		m.Files = append(m.Files, manifestEntry{Name: name, File: name, Format: "png"})
+	}
+	dedupImages(bdir, m, mode, &strbuilder{})
+	return bdir, m
+}
+
+var dedupImagesSet = map[string]image.Image{
+	"small.png": gradient(80, 60, false),
+	"large.png": gradient(160, 120, false),
+	// the same hash as the others, but not the same picture
+	"tall.png": gradient(10, 100, false),
+}
+
+func TestDedupDrop(t *testing.T) {
+	bdir, m := dedupBoard(t, "drop", dedupImagesSet)
+	small, large, tall := m.Files[0], m.Files[1], m.Files[2]
+	if !small.Dropped || small.Duplicate != "large.png" || gtc.IsFile(filepath.Join(bdir, "small.png")) {
+		t.Errorf("small = %+v, want dropped as duplicate of large", small)
+	}
+	if large.Dropped || large.Duplicate != "" || !gtc.IsFile(filepath.Join(bdir, "large.png")) {
+		t.Errorf("large = %+v, want kept", large)
+	}
+	if tall.Dropped || tall.Duplicate != "" || !gtc.IsFile(filepath.Join(bdir, "tall.png")) {
+		t.Errorf("tall = %+v, want kept for its aspect ratio", tall)
+	}
+}
+
+func TestDedupGroup(t *testing.T) {
+	bdir, m := dedupBoard(t, "group", dedupImagesSet)
+	small, large, tall := m.Files[0], m.Files[1], m.Files[2]
+	moved := duplicateDir + "/small.png"
+	if small.Dropped || small.File != moved || small.Duplicate != "large.png" {
+		t.Errorf("small = %+v, want grouped as duplicate of large", small)
+	}
+	if !gtc.IsFile(filepath.Join(bdir, filepath.FromSlash(moved))) {
+		t.Error("small is not moved into duplicates")
+	}
+	if large.File != "large.png" || tall.File != "tall.png" || tall.Duplicate != "" {
+		t.Errorf("large = %+v, tall = %+v, want kept in place", large, tall)
+	}
+}
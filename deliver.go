@@ -0,0 +1,344 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// deliver archives to user's webdav or sftp storage
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// delivery is the target of the delivery field in download request
+type delivery struct {
+	Type   string `json:"type"`   // webdav or sftp
+	URL    string `json:"url"`    // webdav collection url or sftp://host:port/path
+	Unpack bool   `json:"unpack"` // push the unpacked folder instead of the archive
+	Sealed string `json:"sealed"` // sealed credentials, see unseal
+
+	creds credentials
+}
+
+type credentials struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	PrivateKey string `json:"private_key"` // sftp only, pem format
+	HostKey    string `json:"host_key"`    // sftp only and required, authorized_keys format
+}
+
+// unseal decrypts the credentials, sealed is base64 of nonce + ciphertext of
+// the credentials json with AES-256-GCM, the key is sha256 of token
+func unseal(sealed string) (c credentials, err error) {
+	if sealed == "" {
+		return
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return
+	}
+	cfgMu.RLock()
+	key := sha256.Sum256([]byte(token))
+	cfgMu.RUnlock()
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+	if len(raw) < gcm.NonceSize() {
+		err = errors.New("invalid sealed credentials")
+		return
+	}
+	plain, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+	if err != nil {
+		err = errors.New("invalid sealed credentials")
+		return
+	}
+	err = json.Unmarshal(plain, &c)
+	return
+}
+
+// parseDelivery parses the delivery field of download request,
+// nil is returned if it is empty
+func parseDelivery(text string) (*delivery, error) {
+	if text == "" {
+		return nil, nil
+	}
+	d := &delivery{}
+	if err := json.Unmarshal([]byte(text), d); err != nil {
+		return nil, errors.New("invalid delivery")
+	}
+	u, err := url.Parse(d.URL)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("invalid delivery url")
+	}
+	switch d.Type {
+	case "webdav":
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, errors.New("invalid delivery url")
+		}
+	case "sftp":
+		if u.Scheme != "sftp" {
+			return nil, errors.New("invalid delivery url")
+		}
+	default:
+		return nil, errors.New("invalid delivery type")
+	}
+	d.creds, err = unseal(d.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	// credentials are not sent to an sftp host that is not verified
+	if d.Type == "sftp" {
+		if d.creds.HostKey == "" {
+			return nil, errors.New("sftp delivery needs host_key")
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(d.creds.HostKey)); err != nil {
+			return nil, errors.New("invalid sftp host_key")
+		}
+	}
+	return d, nil
+}
+
+// deliverer uploads files to a remote directory, names are relative to it
+type deliverer interface {
+	Mkdir(name string) error
+	Put(name string, r io.Reader, size int64) error
+	Close() error
+}
+
+func (d *delivery) open() (deliverer, error) {
+	if d.Type == "sftp" {
+		return dialSFTP(d.URL, d.creds)
+	}
+	return &webdav{
+		base:   strings.TrimSuffix(d.URL, "/"),
+		creds:  d.creds,
+		client: &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+// deliverFile pushes a local file to the target
+func (d *delivery) deliverFile(filename string) error {
+	dv, err := d.open()
+	if err != nil {
+		return err
+	}
+	defer dv.Close()
+	return putFile(dv, filename, filepath.Base(filename))
+}
+
+// deliverDir pushes all files of a local directory into the same named
+// folder of the target
+func (d *delivery) deliverDir(localDir string) error {
+	dv, err := d.open()
+	if err != nil {
+		return err
+	}
+	defer dv.Close()
+	root := filepath.Base(localDir)
+	return filepath.Walk(localDir, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, fn)
+		if err != nil {
+			return err
+		}
+		name := path.Join(root, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			return dv.Mkdir(name)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return putFile(dv, fn, name)
+	})
+}
+
+func putFile(dv deliverer, filename, name string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return dv.Put(name, f, fi.Size())
+}
+
+// deliverStatus returns the delivery result reported by callback
+func deliverStatus(err error) string {
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+	return "ok"
+}
+
+type webdav struct {
+	base   string
+	creds  credentials
+	client *http.Client
+}
+
+func (w *webdav) do(method, name string, body io.Reader, size int64) (*http.Response, error) {
+	u := w.base + "/" + (&url.URL{Path: name}).EscapedPath()
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if w.creds.Username != "" {
+		req.SetBasicAuth(w.creds.Username, w.creds.Password)
+	}
+	req.Header.Set("User-Agent", "tdi/v"+version)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// Mkdir creates a collection, it is ok if it already exists
+func (w *webdav) Mkdir(name string) error {
+	resp, err := w.do("MKCOL", name+"/", nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("webdav mkcol %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+func (w *webdav) Put(name string, r io.Reader, size int64) error {
+	resp, err := w.do("PUT", name, r, size)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webdav put %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+func (w *webdav) Close() error {
+	return nil
+}
+
+type sftpTarget struct {
+	conn   *ssh.Client
+	client *sftp.Client
+	base   string
+}
+
+func dialSFTP(target string, c credentials) (*sftpTarget, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	var auth []ssh.AuthMethod
+	if c.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(c.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if c.Password != "" {
+		auth = append(auth, ssh.Password(c.Password))
+	}
+	if c.HostKey == "" {
+		return nil, errors.New("sftp delivery needs host_key")
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c.HostKey))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            c.Username,
+		Auth:            auth,
+		HostKeyCallback: ssh.FixedHostKey(pk),
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	base := u.Path
+	if base == "" {
+		base = "."
+	}
+	if err := client.MkdirAll(base); err != nil {
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+	return &sftpTarget{conn, client, base}, nil
+}
+
+func (s *sftpTarget) Mkdir(name string) error {
+	return s.client.MkdirAll(path.Join(s.base, name))
+}
+
+func (s *sftpTarget) Put(name string, r io.Reader, size int64) error {
+	f, err := s.client.Create(path.Join(s.base, name))
+	if err != nil {
+		return err
+	}
+	_, err = f.ReadFrom(r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *sftpTarget) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
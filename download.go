@@ -13,56 +13,75 @@
    See the License for the specific language governing permissions and
    limitations under the License.
 */
-// download in web & clean download in cli
+// download in web
 
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"pkg.tcw.im/gtc"
 )
 
+// strbuilder collects job warnings, it is shared by download coroutines
 type strbuilder struct {
-	b strings.Builder
+	mu sync.Mutex
+	b  strings.Builder
 }
 
-func (s strbuilder) WriteS(text string) {
+func (s *strbuilder) WriteS(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.b.WriteString(text + "\n")
 }
 
-func (s strbuilder) WriteE(err error) {
-	s.b.WriteString(err.Error() + "\n")
+func (s *strbuilder) WriteE(err error) {
+	s.WriteS(err.Error())
 }
 
-func (s strbuilder) String() string {
+func (s *strbuilder) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.b.String()
 }
 
-func (s strbuilder) Len() int {
+func (s *strbuilder) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.b.Len()
 }
 
-func (s strbuilder) FlushReadme() error {
+func (s *strbuilder) FlushReadme() error {
 	return os.WriteFile("README.txt", []byte(s.String()), 0755)
 }
 
 func downloadBoard(data *download) {
 	log.Printf("download start for %s in %s\n", data.Uifn, dir)
+	// the checkpoint is kept only if the job is suspended to resume
+	suspended := false
+	defer func() { jobs.remove(data.Uifn, suspended) }()
+
+	// settings may be reloaded, the job uses those at its start
+	cfgMu.RLock()
+	maxGo, ua, attempt := concurrency, userAgent, time.Duration(timeout)*time.Second
+	hbRef, dtRef, pinKB := huabanReferer, duitangReferer, pinSize
+	jobBW := newBandwidth(jobDownloadLimit)
+	cfgMu.RUnlock()
 
 	pins := data.downloads
 	maxs := int(data.MAXBoardNumber)
-	readme := strbuilder{}
+	readme := &strbuilder{}
 	var allowDown bool = true
 	if len(pins) > maxs {
 		pins = pins[:maxs]
@@ -80,16 +99,36 @@ func downloadBoard(data *download) {
 	} else {
 		gs = 1
 	}
+	// concurrency is the number of coroutines, not pins of a coroutine
+	if maxGo > 0 {
+		gs = int(maxGo)
+		if gs > len(pins) {
+			gs = len(pins)
+		}
+		if gs < 1 {
+			gs = 1
+		}
+	}
+
+	// construct the request header
+	var ref string
+	if data.Site == 1 {
+		ref = fmt.Sprintf(hbRef, data.BoardId)
+	} else {
+		ref = fmt.Sprintf(dtRef, data.BoardId)
+	}
+	headers := make(map[string]string)
+	headers["Referer"] = ref
+	headers["User-Agent"] = ua
 
-	dp, err := diskRate(dir)
+	// reserve disk space for the board and its archive
+	est := estimatePinSize(data.Site, pins, headers, attempt, pinKB) * int64(len(pins)) * 2
+	err := ledger.reserve(data.Uifn, data.Site, len(pins), est, data.DiskLimit)
 	if err != nil {
 		allowDown = false
 		readme.WriteE(err)
 	}
-	if dp > data.DiskLimit {
-		allowDown = false
-		readme.WriteS("disk usage is too high")
-	}
+	defer ledger.release(data.Uifn)
 
 	err = os.Chdir(dir)
 	if err != nil {
@@ -97,11 +136,12 @@ func downloadBoard(data *download) {
 	}
 	err = gtc.CreateDir(data.BoardId)
 	if err != nil {
-		log.Printf("create board directory failed: %s\n", err.Error())
+		data.fail("create board directory failed: " + err.Error())
 		return
 	}
 	// root directory of current and subsequent coroutines
 	os.Chdir(data.BoardId)
+	bdir := filepath.Join(dir, data.BoardId)
 
 	// split download pins
 	spins, err := splitPins(pins, gs)
@@ -114,22 +154,27 @@ func downloadBoard(data *download) {
 	if !allowDown {
 		log.Println("system judgment is not allowed to download")
 		readme.FlushReadme()
+		data.fail(strings.TrimSpace(readme.String()))
 		return
 	}
+	data.event(actionStarted, map[string]string{"pins": fmt.Sprintf("%d", len(pins))})
 
 	// start to download
 	nt := nowTimestamp()
-	// construct the request header
-	var ref string
-	if data.Site == 1 {
-		ref = fmt.Sprintf("https://huaban.com/boards/%s", data.BoardId)
-	} else {
-		ref = fmt.Sprintf("https://www.duitang.com/album/?id=%s", data.BoardId)
-	}
-	headers := make(map[string]string)
-	headers["Referer"] = ref
-	headers["User-Agent"] = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:121.0) Gecko/20100101 Firefox/121.0"
 
+	data.total.Store(int32(len(pins)))
+	// landed records a pin in the reservation, the job stops if it is short
+	var short atomic.Value
+	landed := func(fn string, written bool) {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			ledger.skip(data.Uifn)
+			return
+		}
+		if err := ledger.land(data.Uifn, fi.Size(), written); err != nil {
+			short.CompareAndSwap(nil, err.Error())
+		}
+	}
 	var wg sync.WaitGroup
 	for _, sp := range spins {
 		wg.Add(1)
@@ -137,145 +182,190 @@ func downloadBoard(data *download) {
 		go func(sp []pin) {
 			defer wg.Done()
 			for _, p := range sp {
+				if data.cancelled.Load() || data.suspended.Load() || short.Load() != nil {
+					return
+				}
 				func(p pin) {
-					if gtc.IsFile(p.Name) {
+					defer func() {
+						data.progress(int(data.done.Add(1)), len(pins))
+					}()
+					fn := filepath.Join(bdir, p.Name)
+					if gtc.IsFile(fn) {
+						landed(fn, false)
 						return
 					}
-					dp, _ := diskRate(dir)
-					if dp > data.DiskLimit {
-						readme.WriteS("disk usage is too high")
+					if imgCache != nil && imgCache.fetch(p.URL, fn) {
+						landed(fn, false)
 						return
 					}
+					// be polite to the image host, it may ban us
+					hl := hostLimit(data.Site, p.URL)
+					hl.acquire()
+					defer hl.release()
 					var retry time.Duration = 1
 					var resp *http.Response
 					var err error
 					for retry <= 3 {
-						resp, err = httpGet(p.URL, headers, retry*10*time.Second)
-						if err == nil {
+						hl.wait()
+						resp, err = httpGet(data.Site, p.URL, headers, retry*attempt)
+						if err == nil && throttled(resp) {
+							hl.slowdown(retryAfter(resp))
+							resp.Body.Close()
+							err = fmt.Errorf("%s: %s", p.URL, resp.Status)
+						} else if err == nil && resp.StatusCode/100 == 5 {
+							// other server errors may be transient
+							resp.Body.Close()
+							err = fmt.Errorf("%s: %s", p.URL, resp.Status)
+						} else if err == nil {
+							hl.speedup()
 							break
 						}
 						retry++
 					}
+					// an error page is not the image
+					if err == nil && resp.StatusCode/100 != 2 {
+						resp.Body.Close()
+						err = fmt.Errorf("%s: %s", p.URL, resp.Status)
+					}
 					if err != nil {
+						ledger.skip(data.Uifn)
 						readme.WriteE(err)
 						return
 					}
 					defer resp.Body.Close()
-					pf, err := os.Create(p.Name)
+					// write to a part file first, so that an interrupted
+					// download does not leave a broken image
+					pf, err := os.Create(fn + ".part")
 					if err != nil {
+						ledger.skip(data.Uifn)
 						readme.WriteE(err)
 						return
 					}
-					defer pf.Close()
-					io.Copy(pf, resp.Body)
-					time.Sleep(10 * time.Millisecond)
+					h := sha256.New()
+					body := &limitedReader{resp.Body, []*bandwidth{downloadBW, jobBW}}
+					_, err = io.Copy(io.MultiWriter(pf, h), body)
+					pf.Close()
+					if err == nil {
+						err = os.Rename(fn+".part", fn)
+					}
+					if err != nil {
+						os.Remove(fn + ".part")
+						ledger.skip(data.Uifn)
+						readme.WriteE(err)
+						return
+					}
+					landed(fn, true)
+					if imgCache != nil && resp.StatusCode == http.StatusOK {
+						imgCache.store(p.URL, fn, hex.EncodeToString(h.Sum(nil)))
+					}
 				}(p)
 			}
 		}(sp)
 	}
 	wg.Wait()
+	if data.cancelled.Load() {
+		log.Printf("download cancelled for %s\n", data.Uifn)
+		os.Chdir(dir)
+		os.RemoveAll(data.BoardId)
+		rmserialize(data.Uifn)
+		data.event(actionCancelled, nil)
+		return
+	}
+	if !jobs.finish(data) {
+		log.Printf("download suspended for %s, resume on next start\n", data.Uifn)
+		suspended = true
+		return
+	}
+	if reason := short.Load(); reason != nil {
+		os.Chdir(dir)
+		os.RemoveAll(data.BoardId)
+		data.fail(reason.(string))
+		return
+	}
+
+	// post-process downloaded files
+	mf := newManifest(data)
+	mf.collect(bdir, pins, readme)
+	if data.Convert != "" {
+		log.Println("convert images")
+		convertImages(bdir, mf, data.Convert, data.KeepOriginal, readme)
+	}
+	if data.StripMeta {
+		log.Println("strip metadata")
+		stripMeta(bdir, mf, readme)
+	}
+	if data.Dedup != "" {
+		log.Println("detect duplicate images")
+		dedupImages(bdir, mf, data.Dedup, readme)
+	}
+	if data.Thumbs || data.ContactSheet > 0 {
+		log.Println("generate thumbnails")
+		makeThumbs(bdir, mf.kept(), data.Thumbs, int(data.ContactSheet), readme)
+	}
+	if data.Gallery {
+		err = makeGallery(bdir, data, mf.kept(), ref)
+		if err != nil {
+			log.Printf("make gallery failed: %s\n", err.Error())
+		}
+	}
+	if err = mf.write(bdir); err != nil {
+		readme.WriteE(err)
+	}
 	if readme.Len() > 0 {
 		log.Println("discover warning tips for Readme.txt")
 		readme.FlushReadme()
 	}
+	var deliverErr error
+	if data.deliver != nil && data.deliver.Unpack {
+		log.Printf("deliver board to %s\n", data.deliver.Type)
+		deliverErr = data.deliver.deliverDir(bdir)
+	}
 	os.Chdir(dir)
 	log.Println("downloading end, make tar")
 
 	dtime := nowTimestamp() - nt
 	exclude := []string{".zip", ".lock", ".tar"}
+	defer os.RemoveAll(data.BoardId)
 	err = makeTarFile(data.Uifn, data.BoardId, exclude)
 	if err != nil {
-		log.Println(err)
+		data.fail("make tar failed: " + err.Error())
 		return
 	}
 	ui, err := os.Stat(data.Uifn)
 	if err != nil {
-		log.Println(err)
+		data.fail(err.Error())
 		return
 	}
-	defer os.Remove(data.BoardId)
 	size := formatSize(ui.Size())
+	if data.deliver != nil && !data.deliver.Unpack {
+		log.Printf("deliver archive to %s\n", data.deliver.Type)
+		deliverErr = data.deliver.deliverFile(filepath.Join(dir, data.Uifn))
+	}
+	if deliverErr != nil {
+		log.Printf("deliver failed: %s\n", deliverErr.Error())
+	}
+	err = storeArchive(data.Uifn)
+	if err != nil {
+		data.fail("store archive failed: " + err.Error())
+		return
+	}
 	body := make(map[string]string)
 	body["uifn"] = data.Uifn
 	body["uifnKey"] = data.UifnKey
 	body["size"] = size
 	body["dtime"] = fmt.Sprintf("%d", dtime)
+	if u, err := archives.Presign(data.Uifn, presignExpire(unixSeconds(data.Etime))); err == nil {
+		body["url"] = u
+	}
+	if data.deliver != nil {
+		body["delivery"] = deliverStatus(deliverErr)
+	}
 	log.Printf("Post data: %v\n", body)
-	resp, err := httpPost(fmt.Sprintf("%s?Action=FIRST_STATUS", data.CallbackURL), body)
+	err = callbacks.enqueue(data.CallbackURL, actionDone, body, data.CallbackJSON)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	defer resp.Body.Close()
-	text, err := io.ReadAll(resp.Body)
-	if err == nil {
-		log.Printf("Update download status for %s, resp is %s\n", data.Uifn, string(text))
-	} else {
-		log.Println("Read first post callback result failed")
-	}
 
 	log.Println("download over, successfully")
 }
-
-// perform a cleanup
-func cleanDownload(hours int) {
-	dfs, err := os.ReadDir(dir)
-	if err != nil {
-		return
-	}
-	for _, f := range dfs {
-		if !f.Type().IsRegular() {
-			continue
-		}
-		// n is Uifn
-		n := f.Name()
-		if path.Ext(n) != ".tar" {
-			continue
-		}
-		ns := strings.Split(strings.TrimSuffix(n, path.Ext(n)), "_")
-		if len(ns) < 2 {
-			continue
-		}
-		aid := ns[0]
-		mst, err := strconv.Atoi(ns[1])
-		if err != nil {
-			continue
-		}
-		if aid != "hb" {
-			continue
-		}
-		// checked pass, enter the processing flow
-		fi, fierr := f.Info()
-		if fierr != nil {
-			continue
-		}
-		ctime := mst / 1000
-		fctime := fi.ModTime().Unix()
-		ltime := 60 * 60 * hours
-		nt := nowTimestamp()
-		if (ctime+ltime) <= int(nt) && (fctime+int64(ltime)) <= nt {
-			// expired, clean and report
-			var data clean
-			err := deserialize(&data, n)
-			if err != nil {
-				continue
-			}
-
-			body := make(map[string]string)
-			body["uifn"] = data.Uifn
-			resp, err := httpPost(fmt.Sprintf("%s?Action=SECOND_STATUS", data.CallbackURL), body)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			defer resp.Body.Close()
-			text, err := io.ReadAll(resp.Body)
-			if err != nil {
-				continue
-			}
-			rmserialize(n)
-			os.Remove(filepath.Join(dir, n))
-			log.Printf("Update expired status for %s, resp is %s", n, string(text))
-		}
-	}
-}
@@ -0,0 +1,73 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// job lifecycle callback events
+
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// callback actions, FIRST_STATUS and SECOND_STATUS are always sent,
+// others are sent only if the job asks for callback events
+const (
+	actionDone       = "FIRST_STATUS"
+	actionExpired    = "SECOND_STATUS"
+	actionAccepted   = "ACCEPTED"
+	actionStarted    = "STARTED"
+	actionProgress   = "PROGRESS"
+	actionFailed     = "FAILED"
+	actionCancelled  = "CANCELLED"
+	actionDownloaded = "DOWNLOADED"
+)
+
+// progressMilestones are the percents of pins reported by PROGRESS
+var progressMilestones = []int{25, 50, 75}
+
+// event queues a lifecycle callback of the job, extra is merged into body
+func (data *download) event(action string, extra map[string]string) {
+	if !data.CallbackEvents {
+		return
+	}
+	body := map[string]string{"uifn": data.Uifn, "uifnKey": data.UifnKey}
+	for k, v := range extra {
+		body[k] = v
+	}
+	err := callbacks.enqueue(data.CallbackURL, action, body, data.CallbackJSON)
+	if err != nil {
+		log.Printf("queue %s callback failed: %s\n", action, err.Error())
+	}
+}
+
+// fail reports the job as failed with reason
+func (data *download) fail(reason string) {
+	log.Printf("download failed for %s: %s\n", data.Uifn, reason)
+	data.event(actionFailed, map[string]string{"reason": reason})
+}
+
+// progress reports the milestones passed from done-1 to done pins of total
+func (data *download) progress(done, total int) {
+	for _, m := range progressMilestones {
+		if (done-1)*100 < m*total && done*100 >= m*total {
+			data.event(actionProgress, map[string]string{
+				"percent": fmt.Sprintf("%d", m),
+				"done":    fmt.Sprintf("%d", done),
+				"total":   fmt.Sprintf("%d", total),
+			})
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// image format detection by magic bytes
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"pkg.tcw.im/gtc"
+)
+
+// formatExt maps the detected format to the preferred file extension
+var formatExt = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"webp": ".webp",
+	"bmp":  ".bmp",
+	"tiff": ".tiff",
+	"avif": ".avif",
+	"heic": ".heic",
+}
+
+// extAlias lists other extensions accepted for a format
+var extAlias = map[string][]string{
+	"jpeg": {".jpeg", ".jpe"},
+	"tiff": {".tif"},
+}
+
+// sniffFormat returns the image format according to the file header,
+// or an empty string if it is unknown
+func sniffFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, 0xd8, 0xff}):
+		return "jpeg"
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "gif"
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return "webp"
+	case bytes.HasPrefix(head, []byte("BM")):
+		return "bmp"
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "tiff"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		switch string(head[8:12]) {
+		case "avif", "avis":
+			return "avif"
+		case "heic", "heix", "hevc", "hevx", "mif1", "msf1":
+			return "heic"
+		}
+	}
+	return ""
+}
+
+// detectFormat reads the header of the file and sniffs its format
+func detectFormat(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 16)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return sniffFormat(head[:n]), nil
+}
+
+// matchExt reports whether the extension of name fits the format
+func matchExt(name, format string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == formatExt[format] {
+		return true
+	}
+	return gtc.StrInSlice(ext, extAlias[format])
+}
+
+// uniqueName returns base+ext, or base_N+ext if the file exists in bdir
+func uniqueName(bdir, base, ext string) string {
+	name := base + ext
+	for i := 1; gtc.IsFile(filepath.Join(bdir, name)); i++ {
+		name = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+	return name
+}
+
+// fixExt renames the file in bdir whose extension does not match its
+// real format, the new name is returned, it avoids overwriting other files
+func fixExt(bdir, name, format string) (string, error) {
+	ext, ok := formatExt[format]
+	if !ok || matchExt(name, format) {
+		return name, nil
+	}
+	newName := uniqueName(bdir, strings.TrimSuffix(name, path.Ext(name)), ext)
+	err := os.Rename(filepath.Join(bdir, name), filepath.Join(bdir, newName))
+	if err != nil {
+		return name, err
+	}
+	return newName, nil
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// static html gallery bundled in archive
+
+package main
+
+import (
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"pkg.tcw.im/gtc"
+)
+
+const galleryName = "index.html"
+
+type galleryItem struct {
+	Name  string // original pin name
+	File  string // file name relative to the board directory
+	Thumb string // thumbnail or the file itself
+	URL   string // source link
+}
+
+type galleryPage struct {
+	Title    string
+	BoardURL string
+	Ctime    string
+	Items    []galleryItem
+}
+
+var galleryTpl = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body{margin:0;padding:16px;font-family:sans-serif;background:#f5f5f5;color:#333}
+h1{font-size:20px;margin:0 0 4px}
+header p{margin:0 0 16px;font-size:13px;color:#888}
+a{color:#e8546a;text-decoration:none}
+.grid{display:grid;grid-template-columns:repeat(auto-fill,minmax(180px,1fr));gap:12px}
+.item{background:#fff;border-radius:4px;overflow:hidden;box-shadow:0 1px 3px rgba(0,0,0,.1)}
+.item img{display:block;width:100%;height:180px;object-fit:cover;background:#eee}
+.item p{margin:0;padding:6px 8px;font-size:12px;white-space:nowrap;overflow:hidden;text-overflow:ellipsis}
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<p>{{len .Items}} images, downloaded at {{.Ctime}}, board: <a href="{{.BoardURL}}" target="_blank" rel="noopener">{{.BoardURL}}</a></p>
+</header>
+<div class="grid">
+{{- range .Items}}
+<div class="item">
+<a href="{{.File}}" target="_blank"><img src="{{.Thumb}}" alt="{{.Name}}" loading="lazy"></a>
+<p title="{{.Name}}">{{.Name}} · <a href="{{.URL}}" target="_blank" rel="noopener">source</a></p>
+</div>
+{{- end}}
+</div>
+</body>
+</html>
+`))
+
+// makeGallery writes an offline browsable index.html into the board directory
+func makeGallery(bdir string, data *download, files []manifestEntry, boardURL string) error {
+	title := data.BoardTitle
+	if title == "" {
+		title = data.BoardId
+	}
+	page := galleryPage{
+		Title:    title,
+		BoardURL: boardURL,
+		Ctime:    time.Now().Format("2006-01-02 15:04:05"),
+	}
+	for _, e := range files {
+		thumb := path.Join(thumbDir, thumbName(e.File))
+		if !gtc.IsFile(filepath.Join(bdir, thumb)) {
+			thumb = e.File
+		}
+		page.Items = append(page.Items, galleryItem{e.Name, e.File, thumb, e.URL})
+	}
+	f, err := os.Create(filepath.Join(bdir, galleryName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return galleryTpl.Execute(f, page)
+}
@@ -0,0 +1,170 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// per-host rate limiting of image downloads
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// the rate is not lowered below this on 429 and 503
+	minHostRate = 0.2
+	// the longest pause of Retry-After
+	maxHostPause = 5 * time.Minute
+	// the pause if the throttled response has no Retry-After
+	defaultHostPause = 5 * time.Second
+)
+
+// hostLimiter is a token bucket of requests to one image host, with a limit
+// of concurrent connections. The rate is halved on 429 and 503 responses and
+// recovers slowly on success.
+type hostLimiter struct {
+	mu     sync.Mutex
+	host   string
+	base   float64 // configured requests per second
+	rate   float64 // current requests per second
+	tokens float64
+	last   time.Time
+	until  time.Time // paused by Retry-After
+	conns  chan struct{}
+}
+
+func newHostLimiter(host string, rate float64, conns uint) *hostLimiter {
+	return &hostLimiter{
+		host:   host,
+		base:   rate,
+		rate:   rate,
+		tokens: math.Max(rate, 1),
+		last:   time.Now(),
+		conns:  make(chan struct{}, conns),
+	}
+}
+
+// wait blocks until a request to the host is allowed
+func (h *hostLimiter) wait() {
+	for {
+		h.mu.Lock()
+		now := time.Now()
+		var d time.Duration
+		if now.Before(h.until) {
+			d = h.until.Sub(now)
+		} else {
+			burst := math.Max(h.rate, 1)
+			h.tokens = math.Min(burst, h.tokens+now.Sub(h.last).Seconds()*h.rate)
+			h.last = now
+			if h.tokens >= 1 {
+				h.tokens--
+				h.mu.Unlock()
+				return
+			}
+			d = time.Duration((1 - h.tokens) / h.rate * float64(time.Second))
+		}
+		h.mu.Unlock()
+		time.Sleep(d)
+	}
+}
+
+// acquire takes a connection of the host, release gives it back
+func (h *hostLimiter) acquire() {
+	h.conns <- struct{}{}
+}
+
+func (h *hostLimiter) release() {
+	<-h.conns
+}
+
+// slowdown halves the rate and pauses the host for the time of Retry-After
+func (h *hostLimiter) slowdown(pause time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if pause <= 0 {
+		pause = defaultHostPause
+	}
+	if pause > maxHostPause {
+		pause = maxHostPause
+	}
+	h.rate = math.Max(h.rate/2, minHostRate)
+	h.tokens = 0
+	if until := time.Now().Add(pause); until.After(h.until) {
+		h.until = until
+	}
+	log.Printf("host %s is throttled, slow down to %.2f/s and pause %s\n", h.host, h.rate, pause)
+}
+
+// speedup raises the rate a little towards the configured one
+func (h *hostLimiter) speedup() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rate < h.base {
+		h.rate = math.Min(h.base, h.rate+h.base/20)
+	}
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = make(map[string]*hostLimiter)
+)
+
+// hostLimit returns the limiter of the host of rawurl with the settings of
+// the site, it is shared by all jobs
+func hostLimit(site uint8, rawurl string) *hostLimiter {
+	host := rawurl
+	if u, err := url.Parse(rawurl); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	key := fmt.Sprintf("%d/%s", site, host)
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	h, ok := limiters[key]
+	if !ok {
+		if site == 1 {
+			h = newHostLimiter(host, huabanRate, huabanConns)
+		} else {
+			h = newHostLimiter(host, duitangRate, duitangConns)
+		}
+		limiters[key] = h
+	}
+	return h
+}
+
+// throttled reports whether the response asks the client to slow down
+func throttled(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// retryAfter parses the Retry-After header in seconds or http date
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
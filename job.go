@@ -0,0 +1,161 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// registry of running download jobs
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+)
+
+var jobs = &jobRegistry{m: make(map[string]*download)}
+
+var (
+	errJobRunning = errors.New("job is already running")
+	errJobLimit   = errors.New("job queue is full")
+)
+
+// jobRegistry holds the jobs that are accepted and not finished, by Uifn
+type jobRegistry struct {
+	mu sync.Mutex
+	m  map[string]*download
+}
+
+func (r *jobRegistry) add(data *download) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addLocked(data)
+}
+
+// addIfBelow adds the job only if it is not running and fewer than limit
+// jobs are running, 0 is unlimited. The check and add are atomic, so that
+// concurrent requests can not exceed the limit or start a job twice.
+func (r *jobRegistry) addIfBelow(data *download, limit int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.m[data.Uifn]; ok {
+		return errJobRunning
+	}
+	if limit > 0 && len(r.m) >= limit {
+		return errJobLimit
+	}
+	r.addLocked(data)
+	return nil
+}
+
+func (r *jobRegistry) addLocked(data *download) {
+	r.m[data.Uifn] = data
+	if err := saveRunRecord(data); err != nil {
+		log.Printf("run record of %s failed: %s\n", data.Uifn, err.Error())
+	}
+}
+
+// remove unregisters the finished job, its checkpoint is removed too
+// unless it is suspended to resume
+func (r *jobRegistry) remove(uifn string, resumable bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, uifn)
+	removeRunRecord(uifn)
+	if !resumable {
+		removeCheckpoint(uifn)
+	}
+}
+
+// has reports whether the job of uifn is running
+func (r *jobRegistry) has(uifn string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.m[uifn]
+	return ok
+}
+
+// hasBoard reports whether a running job uses the board directory
+func (r *jobRegistry) hasBoard(boardId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, data := range r.m {
+		if data.BoardId == boardId {
+			return true
+		}
+	}
+	return false
+}
+
+// cancel marks the job of uifn as cancelled, the download stops before its
+// next pin. It returns false if the job is not running.
+func (r *jobRegistry) cancel(uifn string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, ok := r.m[uifn]
+	if ok {
+		data.cancelled.Store(true)
+	}
+	return ok
+}
+
+// list returns the running jobs
+func (r *jobRegistry) list() []*download {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*download, 0, len(r.m))
+	for _, data := range r.m {
+		list = append(list, data)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Uifn < list[j].Uifn })
+	return list
+}
+
+// suspend checkpoints the running jobs and stops them before their next
+// pin, it returns the number of suspended jobs. Jobs past downloading are
+// not suspended, they are let to finish.
+func (r *jobRegistry) suspend() (n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, data := range r.m {
+		if data.finishing.Load() {
+			continue
+		}
+		if err := saveCheckpoint(data); err != nil {
+			log.Printf("checkpoint %s failed: %s\n", data.Uifn, err.Error())
+			continue
+		}
+		data.suspended.Store(true)
+		n++
+	}
+	return
+}
+
+// finish marks the job as past downloading, so that it is not suspended.
+// It returns false if the job is already suspended.
+func (r *jobRegistry) finish(data *download) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if data.suspended.Load() {
+		return false
+	}
+	data.finishing.Store(true)
+	return true
+}
+
+func (r *jobRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.m)
+}
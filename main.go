@@ -25,7 +25,6 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
 	"time"
 
@@ -45,6 +44,10 @@ var (
 
 	noclean   bool // if true, do not delete download file, otherwise, auto delete
 	cleanonce bool
+	dryrun    bool   // with cleanonce, only report what would be removed
+	report    string // clean report format: table or json
+
+	configFile string // yaml or toml config file
 
 	dir    string // download absolute path
 	host   string
@@ -52,6 +55,47 @@ var (
 	token  string
 	status string
 	hour   uint // clean hour
+
+	draining    bool // refuse new download jobs, set by admin api
+	adminStatus bool // status is set by admin api, kept on reload
+
+	grace uint // seconds to wait for running jobs on shutdown
+
+	concurrency     uint // max download coroutines of a job, 0 is auto
+	timeout         uint // seconds of a pin download attempt
+	callbackTimeout uint // seconds of a callback request
+	userAgent       string
+	huabanReferer   string // referer of huaban pins, %s is board id
+	duitangReferer  string // referer of duitang pins, %s is board id
+
+	huabanRate   float64 // requests per second to a huaban image host
+	huabanConns  uint    // connections to a huaban image host
+	duitangRate  float64 // requests per second to a duitang image host
+	duitangConns uint    // connections to a duitang image host
+
+	proxyList    string // comma separated proxies of pin requests
+	huabanProxy  string // proxies of huaban pins, instead of proxyList
+	duitangProxy string // proxies of duitang pins, instead of proxyList
+
+	downloadLimit    uint // KB/s of all pin downloads, 0 is unlimited
+	jobDownloadLimit uint // KB/s of pin downloads of a job
+	uploadLimit      uint // KB/s of all archive responses
+	connUploadLimit  uint // KB/s of an archive response
+
+	jobLimit uint // max running jobs, 0 is unlimited
+	pinSize  uint // average pin size in KB to estimate the board size
+
+	memLimit  float64 // memory usage percent, above which the system is busy
+	loadLimit float64 // load average in 5 minutes, above which the system is busy
+
+	cacheDir   string
+	cacheLimit uint // image cache size in MB, 0 disables the cache
+
+	quota        uint    // max size of archives in MB, 0 is unlimited
+	quotaPercent float64 // max disk usage percent kept by evicting archives
+
+	storageType string // local or s3
+	s3cfg       s3Storage
 )
 
 const d = "downloads"
@@ -72,9 +116,14 @@ func init() {
 	flag.StringVar(&testurl, "testurl", "https://open.saintic.com/CrawlHuaban/ping", "http get test url")
 
 	flag.BoolVar(&cleanonce, "clean-once", false, "")
+	flag.BoolVar(&dryrun, "dry-run", false, "")
+	flag.StringVar(&report, "report", "table", "")
 	flag.BoolVar(&noclean, "noclean", false, "")
 	flag.UintVar(&hour, "hour", 12, "")
 
+	flag.StringVar(&configFile, "c", "", "")
+	flag.StringVar(&configFile, "config", "", "")
+
 	flag.StringVar(&host, "host", "0.0.0.0", "")
 	flag.UintVar(&port, "port", 13145, "")
 
@@ -87,6 +136,46 @@ func init() {
 	flag.StringVar(&status, "s", "ready", "")
 	flag.StringVar(&status, "status", "ready", "")
 
+	flag.UintVar(&concurrency, "concurrency", 0, "")
+	flag.UintVar(&timeout, "timeout", 10, "")
+	flag.UintVar(&callbackTimeout, "callback-timeout", 10, "")
+	flag.StringVar(&userAgent, "user-agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:121.0) Gecko/20100101 Firefox/121.0", "")
+	flag.StringVar(&huabanReferer, "huaban-referer", "https://huaban.com/boards/%s", "")
+	flag.StringVar(&duitangReferer, "duitang-referer", "https://www.duitang.com/album/?id=%s", "")
+	flag.Float64Var(&huabanRate, "huaban-rate", 10, "")
+	flag.UintVar(&huabanConns, "huaban-conns", 8, "")
+	flag.Float64Var(&duitangRate, "duitang-rate", 10, "")
+	flag.UintVar(&duitangConns, "duitang-conns", 8, "")
+	flag.StringVar(&proxyList, "proxy", "", "")
+	flag.StringVar(&huabanProxy, "huaban-proxy", "", "")
+	flag.StringVar(&duitangProxy, "duitang-proxy", "", "")
+
+	flag.UintVar(&downloadLimit, "download-limit", 0, "")
+	flag.UintVar(&jobDownloadLimit, "job-download-limit", 0, "")
+	flag.UintVar(&uploadLimit, "upload-limit", 0, "")
+	flag.UintVar(&connUploadLimit, "conn-upload-limit", 0, "")
+
+	flag.UintVar(&grace, "grace", 20, "")
+
+	flag.UintVar(&jobLimit, "max-jobs", 0, "")
+	flag.UintVar(&pinSize, "pin-size", 512, "")
+
+	flag.Float64Var(&memLimit, "mem-limit", 90, "")
+	flag.Float64Var(&loadLimit, "load-limit", 0, "")
+
+	flag.StringVar(&cacheDir, "cache-dir", "", "")
+	flag.UintVar(&cacheLimit, "cache-limit", 1024, "")
+
+	flag.UintVar(&quota, "quota", 0, "")
+	flag.Float64Var(&quotaPercent, "quota-percent", 0, "")
+
+	flag.StringVar(&storageType, "storage", "local", "")
+	flag.StringVar(&s3cfg.Endpoint, "s3-endpoint", "", "")
+	flag.StringVar(&s3cfg.Region, "s3-region", "", "")
+	flag.StringVar(&s3cfg.Bucket, "s3-bucket", "", "")
+	flag.StringVar(&s3cfg.Prefix, "s3-prefix", "", "")
+	flag.BoolVar(&s3cfg.PathStyle, "s3-path-style", false, "")
+
 	flag.Usage = usage
 }
 
@@ -131,24 +220,94 @@ Flags:
   -h, --help            show this help message and exit
   -v, --version         show cli version and exit
   -i, --info            show version and system info
-      --host            http listen host (default "0.0.0.0", env)
-      --port            http listen port (default 13145, env)
-      --hour            if clean, expiration time (default 12)
-      --noclean         do not automatically clean up download files (env)
+  -c, --config          yaml or toml config file (env tdi_config)
+      --host            http listen host (default "0.0.0.0")
+      --port            http listen port (default 13145)
+      --hour            if clean, expiration hours of archives whose job has
+                        no etime (default 12)
+      --noclean         do not automatically clean up download files
       --clean-once      manually clean up expired files (no run api)
-  -d, --dir             download base directory (default "downloads", env)
-  -t, --token           password to verify identity (required<random>, env)
+      --dry-run         with --clean-once, list what would be removed only
+      --report          clean-once report format: table or json (default "table")
+  -d, --dir             download base directory (default "downloads")
+  -t, --token           password to verify identity (required<random>)
   -s, --status          set service status: ready or tardy, (default "ready")
+      --concurrency     max download coroutines of a job (default 0, auto)
+      --timeout         seconds of a pin download attempt (default 10)
+      --callback-timeout
+                        seconds of a callback request (default 10)
+      --user-agent      user agent of pin downloads (default firefox)
+      --huaban-referer  referer of huaban pins, %s is board id
+                        (default "https://huaban.com/boards/%s")
+      --duitang-referer referer of duitang pins, %s is board id
+                        (default "https://www.duitang.com/album/?id=%s")
+      --huaban-rate     requests per second to a huaban image host, it is
+                        halved on 429 and 503 and recovers slowly (default 10)
+      --huaban-conns    connections to a huaban image host (default 8)
+      --duitang-rate    requests per second to a duitang image host (default 10)
+      --duitang-conns   connections to a duitang image host (default 8)
+      --proxy           comma separated http, https or socks5 proxies of pin
+                        requests, used in turn (default env HTTPS_PROXY)
+      --huaban-proxy    proxies of huaban pins, instead of --proxy
+      --duitang-proxy   proxies of duitang pins, instead of --proxy
+      --download-limit  KB/s of all pin downloads (default 0, unlimited)
+      --job-download-limit
+                        KB/s of pin downloads of a job (default 0, unlimited)
+      --upload-limit    KB/s of all archive downloads by users, only local
+                        storage (default 0, unlimited)
+      --conn-upload-limit
+                        KB/s of an archive download by user (default 0,
+                        unlimited)
+      --grace           seconds to wait for running jobs on shutdown, the
+                        others are suspended and resumed on next start,
+                        the process exits about 5 seconds later (default 20)
+      --max-jobs        max running jobs, others are refused (default 0,
+                        unlimited)
+      --pin-size        average pin size in KB, boards whose estimated size
+                        exceeds the free disk space are refused (default 512)
+      --mem-limit       memory usage percent regarded as busy (default 90)
+      --load-limit      5 minutes load regarded as busy (default cpu number)
+      --cache-dir       image cache directory (default "<dir>/.cache")
+      --cache-limit     image cache size in MB, 0 is disabled (default 1024)
+      --quota           max size of archives in MB, the least recently
+                        used are evicted when exceeded (default 0, unlimited)
+      --quota-percent   max disk usage percent kept by evicting archives
+                        (default 0, disabled)
+      --storage         archive storage: local or s3 (default "local")
+      --s3-endpoint     s3 endpoint url, such as http://127.0.0.1:9000
+      --s3-region       s3 region (default "us-east-1")
+      --s3-bucket       s3 bucket name
+      --s3-prefix       s3 key prefix of archives
+      --s3-path-style   use path-style bucket url, required by minio
+                        (s3 keys are read from env tdi_s3_access_key and
+                        tdi_s3_secret_key, or s3.access_key and
+                        s3.secret_key of config file)
 
       --test            run one http get request to test connection
       --testurl         test url address, http or https
+
+Settings from --host to --s3-path-style can also be set by env tdi_<name>
+with - replaced by _, such as tdi_mem_limit, or by the config file, such as
+mem_limit: 80, where a prefix can be a section, such as s3: {bucket: tdi},
+and proxies can be a list.
+The precedence is flag > env > config file > default.
+
+On SIGHUP, the config file is reloaded without restart, where token, status
+(unless set by the admin api), hour, concurrency, timeout, callback-timeout,
+user-agent, referers, max-jobs, pin-size, bandwidth limits, mem-limit,
+load-limit, quota and quota-percent apply live, others need a restart.
 `
 	fmt.Println(helpStr)
 }
 
 func handle() {
-	if dir == "" {
-		dir = os.Getenv("tdi_dir")
+	errs := append(loadConfig(), validateConfig()...)
+	if len(errs) > 0 {
+		fmt.Println("Invalid configuration:")
+		for _, err := range errs {
+			fmt.Printf("  - %s\n", err.Error())
+		}
+		os.Exit(1)
 	}
 	if dir == "" {
 		dir = d
@@ -161,52 +320,72 @@ func handle() {
 	}
 	isRandomToken := false
 	if token == "" {
-		token = os.Getenv("tdi_token")
-		if token == "" {
-			token = genRandomString(8)
-			isRandomToken = true
-		}
-	}
-	if status == "" {
-		status = os.Getenv("tdi_status")
-	}
-	if status != "tardy" {
-		status = "ready"
+		token = genRandomString(8)
+		isRandomToken = true
 	}
-	if gtc.IsTrue(os.Getenv("tdi_noclean")) {
-		noclean = true
-	}
-	envhost := os.Getenv("tdi_host")
-	envport := os.Getenv("tdi_port")
-	if envhost != "" {
-		host = envhost
+	normalizeConfig()
+	applyBandwidth()
+	if err := setupProxies(); err != nil {
+		fmt.Printf("Invalid proxy: %s\n", err.Error())
+		os.Exit(1)
 	}
-	if envport != "" {
-		envport, err := strconv.Atoi(envport)
+	if storageType == "s3" {
+		s, err := newS3Storage(&s3cfg)
 		if err != nil {
-			fmt.Println("Invalid environment tdi_port")
-			return
+			fmt.Printf("Invalid s3 storage: %s\n", err.Error())
+			os.Exit(1)
 		}
-		port = uint(envport)
+		archives = s
+	} else {
+		archives = &localStorage{dir}
 	}
-	if hour <= 0 {
-		fmt.Println("hour needs to be greater than 0")
+	q, err := newCallbackQueue(callbackDir())
+	if err != nil {
+		fmt.Printf("Invalid callback queue: %s\n", err.Error())
 		os.Exit(1)
 	}
+	callbacks = q
+	// the cache is also evicted by clean-once to keep quota-percent
+	if cacheLimit > 0 {
+		if cacheDir == "" {
+			cacheDir = filepath.Join(dir, ".cache")
+		}
+		c, err := newCache(cacheDir, int64(cacheLimit)<<20)
+		if err != nil {
+			fmt.Printf("Invalid cache directory: %s\n", err.Error())
+			os.Exit(1)
+		}
+		imgCache = c
+	}
 	// run clean download, only once, and exit
 	if cleanonce {
-		cleanDownload(int(hour))
+		if err := printReport(cleanDownload(int(hour)), report); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// try to deliver the expired status before exit, callbacks of the
+		// server are left to it
+		if !dryrun {
+			callbacks.flushEnqueued()
+		}
 		os.Exit(0)
 	}
+	// resume jobs before cleaning, so their boards are not orphans
+	resumeJobs()
 	// start clean download task
 	if !noclean {
 		go func() {
 			for {
-				cleanDownload(int(hour))
+				cfgMu.RLock()
+				hours := int(hour)
+				cfgMu.RUnlock()
+				cleanDownload(hours)
 				time.Sleep(time.Minute)
 			}
 		}()
 	}
+	go callbacks.run()
+	go reloadOnSignal()
 	// start api task
 	e := echo.New()
 	e.HideBanner = true
@@ -215,8 +394,20 @@ func handle() {
 	e.GET("/healthy", healthyView)
 	e.POST("/download", downloadView)
 	e.GET("/downloads/:filename", sendfileView)
+	e.POST("/cancel", cancelView)
+	e.GET("/admin/callbacks", callbacksView)
+	e.POST("/admin/callbacks/replay", replayCallbackView)
+	e.GET("/admin/status", adminStatusView)
+	e.POST("/admin/status", setStatusView)
+	e.POST("/admin/drain", drainView)
 	if isRandomToken {
 		fmt.Println("the randomly generated token is: " + token)
 	}
-	e.Logger.Fatal(e.Start(fmt.Sprintf("%s:%d", host, port)))
+	go func() {
+		err := e.Start(fmt.Sprintf("%s:%d", host, port))
+		if err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+	waitShutdown(e)
 }
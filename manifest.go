@@ -0,0 +1,104 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// archive manifest
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const manifestName = "manifest.json"
+
+type manifestEntry struct {
+	Name   string `json:"name"` // original pin name
+	File   string `json:"file"` // saved file name in archive
+	URL    string `json:"url"`
+	Format string `json:"format,omitempty"`
+	Size   int64  `json:"size"`
+
+	From     string `json:"converted_from,omitempty"` // format before conversion
+	Original string `json:"original,omitempty"`       // kept original file
+	Stripped bool   `json:"stripped,omitempty"`       // metadata removed
+
+	Duplicate string `json:"duplicate_of,omitempty"` // the kept similar file
+	Dropped   bool   `json:"dropped,omitempty"`      // removed as a duplicate
+}
+
+type manifest struct {
+	Uifn    string          `json:"uifn"`
+	Site    uint8           `json:"site"`
+	BoardId string          `json:"board_id"`
+	Title   string          `json:"board_title,omitempty"`
+	Ctime   int64           `json:"ctime"`
+	Files   []manifestEntry `json:"files"`
+}
+
+func newManifest(data *download) *manifest {
+	return &manifest{
+		Uifn:    data.Uifn,
+		Site:    data.Site,
+		BoardId: data.BoardId,
+		Title:   data.BoardTitle,
+		Ctime:   nowTimestamp(),
+	}
+}
+
+// collect records the downloaded pins in bdir, the real format of each
+// file is detected and the extension is corrected if it is wrong
+func (m *manifest) collect(bdir string, pins []pin, readme *strbuilder) {
+	for _, p := range pins {
+		fi, err := os.Stat(filepath.Join(bdir, p.Name))
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		e := manifestEntry{Name: p.Name, File: p.Name, URL: p.URL, Size: fi.Size()}
+		e.Format, err = detectFormat(filepath.Join(bdir, p.Name))
+		if err != nil {
+			readme.WriteS(fmt.Sprintf("detect format %s: %s", p.Name, err.Error()))
+		}
+		if e.Format != "" {
+			e.File, err = fixExt(bdir, p.Name, e.Format)
+			if err != nil {
+				readme.WriteS(fmt.Sprintf("rename %s: %s", p.Name, err.Error()))
+			}
+		}
+		m.Files = append(m.Files, e)
+	}
+}
+
+// kept returns the files that are not duplicates
+func (m *manifest) kept() []manifestEntry {
+	files := make([]manifestEntry, 0, len(m.Files))
+	for _, e := range m.Files {
+		if e.Duplicate == "" {
+			files = append(files, e)
+		}
+	}
+	return files
+}
+
+// write saves the manifest as json into bdir
+func (m *manifest) write(bdir string) error {
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(bdir, manifestName), raw, 0644)
+}
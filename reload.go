@@ -0,0 +1,105 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// reload config file on SIGHUP
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// liveKeys are the config keys applied on reload, others need a restart
+var liveKeys = []string{
+	"token", "status", "hour", "concurrency", "timeout", "callback-timeout",
+	"user-agent", "huaban-referer", "duitang-referer",
+	"max-jobs", "pin-size", "mem-limit", "load-limit", "quota", "quota-percent",
+	"download-limit", "job-download-limit", "upload-limit", "conn-upload-limit",
+}
+
+// cfgMu guards the settings of liveKeys and draining, goroutines running
+// after startup read them with the read lock
+var cfgMu sync.RWMutex
+
+func reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reloadConfig()
+	}
+}
+
+// reloadConfig applies liveKeys of the config file, the old settings are
+// kept if the new ones are invalid
+func reloadConfig() {
+	if configFile == "" {
+		log.Println("reload skipped, no config file")
+		return
+	}
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+
+	keys := liveKeys
+	// the status set by admin api wins over the config file
+	if adminStatus {
+		keys = make([]string, 0, len(liveKeys))
+		for _, k := range liveKeys {
+			if k != "status" {
+				keys = append(keys, k)
+			}
+		}
+	}
+	old := make(map[string]string)
+	for _, k := range keys {
+		old[k] = flag.Lookup(k).Value.String()
+	}
+	file, errs := configFileValues()
+	errs = append(errs, setConfig(keys, file)...)
+	// keep the random token if none is configured
+	if token == "" {
+		token = old["token"]
+	}
+	normalizeConfig()
+	errs = append(errs, validateConfig()...)
+	if len(errs) > 0 {
+		for _, k := range keys {
+			flag.Lookup(k).Value.Set(old[k])
+		}
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		log.Printf("reload config rejected, keep the old one: %s\n", strings.Join(msgs, "; "))
+		return
+	}
+	applyBandwidth()
+	var changed []string
+	for _, k := range keys {
+		if flag.Lookup(k).Value.String() != old[k] {
+			changed = append(changed, k)
+		}
+	}
+	if len(changed) == 0 {
+		log.Printf("reload config %s, nothing changed\n", configFile)
+		return
+	}
+	log.Printf("reload config %s, changed: %s\n", configFile, strings.Join(changed, ", "))
+}
@@ -0,0 +1,210 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// disk space reservation of download jobs
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+const (
+	// statfs of the download directory is refreshed after this
+	ledgerStale = 30 * time.Second
+	// reservations are adjusted once this number of pins landed
+	minLanded = 5
+	// pins sampled by HEAD requests to estimate the board size
+	sampleSize = 3
+)
+
+// reservation is the disk space a job expects to take, its board directory
+// and archive both take about the size of all pins
+type reservation struct {
+	site    uint8
+	limit   float64 // DISKLIMIT of the job
+	pins    int     // pins to download
+	landed  int     // pins downloaded, or found in board and cache
+	bytes   int64   // size of landed pins
+	written int64   // bytes written to disk by the job
+	size    int64   // bytes reserved
+}
+
+// diskLedger tracks the reservations of running jobs against the free space
+// of the download directory, so that statfs is not called for every pin
+type diskLedger struct {
+	mu      sync.Mutex
+	jobs    map[string]*reservation
+	sites   map[uint8][2]int64 // bytes and number of downloaded pins by site
+	total   int64              // disk size at last statfs
+	used    int64              // used bytes at last statfs
+	since   int64              // bytes written by jobs since last statfs
+	checked time.Time
+}
+
+var ledger = &diskLedger{
+	jobs:  make(map[string]*reservation),
+	sites: make(map[uint8][2]int64),
+}
+
+func (l *diskLedger) refresh() error {
+	obj, err := disk.Usage(dir)
+	if err != nil {
+		return err
+	}
+	l.total = int64(obj.Used + obj.Free)
+	l.used = int64(obj.Used)
+	l.since = 0
+	l.checked = time.Now()
+	return nil
+}
+
+// headroom returns the bytes that can still be reserved below limit percent
+func (l *diskLedger) headroom(limit float64) int64 {
+	free := int64(float64(l.total)*limit/100) - l.used - l.since
+	for _, r := range l.jobs {
+		if r.size > r.written {
+			free -= r.size - r.written
+		}
+	}
+	return free
+}
+
+// available returns the bytes that a new job can reserve below limit percent
+func (l *diskLedger) available(limit float64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.checked) > ledgerStale {
+		if err := l.refresh(); err != nil {
+			return 0, err
+		}
+	}
+	return l.headroom(limit), nil
+}
+
+// reserve reserves size bytes for the job of pins, cached images are evicted
+// if the space is not enough
+func (l *diskLedger) reserve(uifn string, site uint8, pins int, size int64, limit float64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.refresh(); err != nil {
+		return err
+	}
+	if short := size - l.headroom(limit); short > 0 && imgCache != nil && imgCache.evict(short) > 0 {
+		l.refresh()
+	}
+	if size > l.headroom(limit) {
+		return fmt.Errorf("not enough disk space, about %s is needed", formatSize(size))
+	}
+	l.jobs[uifn] = &reservation{site: site, limit: limit, pins: pins, size: size}
+	return nil
+}
+
+// land records a pin of n bytes of the job, written is false if the pin
+// takes no new space, such as linked from cache. The reservation is adjusted
+// by the average size of landed pins, an error is returned if it can not grow.
+func (l *diskLedger) land(uifn string, n int64, written bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.jobs[uifn]
+	if r == nil {
+		return nil
+	}
+	r.landed++
+	r.bytes += n
+	if written {
+		r.written += n
+		l.since += n
+		st := l.sites[r.site]
+		l.sites[r.site] = [2]int64{st[0] + n, st[1] + 1}
+	}
+	if r.landed < minLanded && r.written <= r.size {
+		return nil
+	}
+	remain := r.pins - r.landed
+	if remain < 0 {
+		remain = 0
+	}
+	est := 2 * (r.bytes + r.bytes/int64(r.landed)*int64(remain))
+	if est <= r.size {
+		r.size = est
+		return nil
+	}
+	if time.Since(l.checked) > ledgerStale {
+		l.refresh()
+	}
+	old := r.size
+	r.size = est
+	if l.headroom(r.limit) < 0 {
+		r.size = old
+		return fmt.Errorf("not enough disk space, about %s is needed", formatSize(est))
+	}
+	return nil
+}
+
+// skip records a pin of the job that is not downloaded
+func (l *diskLedger) skip(uifn string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r := l.jobs[uifn]; r != nil && r.pins > 0 {
+		r.pins--
+	}
+}
+
+func (l *diskLedger) release(uifn string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.jobs, uifn)
+}
+
+// averagePinSize returns the average size of downloaded pins of the site,
+// or pin-size setting if there are not enough pins
+func averagePinSize(site uint8, pinKB uint) int64 {
+	ledger.mu.Lock()
+	st := ledger.sites[site]
+	ledger.mu.Unlock()
+	if st[1] >= 10 {
+		return st[0] / st[1]
+	}
+	return int64(pinKB) << 10
+}
+
+// estimatePinSize returns the average size of pins by the Content-Length of
+// HEAD requests of some of them, or averagePinSize if none is known
+func estimatePinSize(site uint8, pins []pin, headers map[string]string, timeout time.Duration, pinKB uint) int64 {
+	var total, n int64
+	step := len(pins)/sampleSize + 1
+	for i := 0; i < len(pins); i += step {
+		hostLimit(site, pins[i].URL).wait()
+		resp, err := httpHead(site, pins[i].URL, headers, timeout)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && resp.ContentLength > 0 {
+			total += resp.ContentLength
+			n++
+		}
+	}
+	if n > 0 {
+		return total / n
+	}
+	return averagePinSize(site, pinKB)
+}
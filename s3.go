@@ -0,0 +1,297 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// s3 compatible storage with aws signature v4
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Storage works with aws s3 and compatible services such as minio
+type s3Storage struct {
+	Endpoint  string // such as https://s3.amazonaws.com or http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // key prefix of archives
+	PathStyle bool   // bucket in path instead of host, required by minio
+
+	client *http.Client
+}
+
+func newS3Storage(s *s3Storage) (*s3Storage, error) {
+	if s.Endpoint == "" || s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+		return nil, errors.New("s3 endpoint, bucket and keys are required")
+	}
+	if _, err := url.Parse(s.Endpoint); err != nil {
+		return nil, err
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+	s.Prefix = strings.Trim(s.Prefix, "/")
+	s.client = &http.Client{Timeout: 10 * time.Minute}
+	return s, nil
+}
+
+func (s *s3Storage) key(name string) string {
+	if s.Prefix == "" {
+		return name
+	}
+	return s.Prefix + "/" + name
+}
+
+// objectURL returns the url of key, an empty key means the bucket
+func (s *s3Storage) objectURL(key string) *url.URL {
+	u, _ := url.Parse(s.Endpoint)
+	p := "/"
+	if s.PathStyle {
+		p += s.Bucket + "/"
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path = p + key
+	u.RawPath = p + s3Escape(key, false)
+	return u
+}
+
+// s3Escape encodes text as aws requires, slash is kept in paths
+func s3Escape(text string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(text) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string{}, q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// signature computes the v4 signature of a request with the given headers,
+// the names of signed headers are returned too
+func (s *s3Storage) signature(method string, u *url.URL, headers http.Header, payload string, t time.Time) (sig, signed string) {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, strings.ToLower(k))
+	}
+	sort.Strings(names)
+	var ch strings.Builder
+	for _, k := range names {
+		ch.WriteString(k + ":" + strings.TrimSpace(headers.Get(k)) + "\n")
+	}
+	signed = strings.Join(names, ";")
+	creq := strings.Join([]string{
+		method, u.EscapedPath(), canonicalQuery(u.Query()), ch.String(), signed, payload,
+	}, "\n")
+	date := t.Format("20060102")
+	hash := sha256.Sum256([]byte(creq))
+	sts := strings.Join([]string{
+		"AWS4-HMAC-SHA256", t.Format("20060102T150405Z"), s.scope(date), hex.EncodeToString(hash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, sts)), signed
+}
+
+func (s *s3Storage) scope(date string) string {
+	return date + "/" + s.Region + "/s3/aws4_request"
+}
+
+// do signs and sends the request, non-2xx responses are returned as error
+func (s *s3Storage) do(method string, u *url.URL, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	t := time.Now().UTC()
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	sig, signed := s.signature(method, req.URL, req.Header, unsignedPayload, t)
+	req.Header.Del("Host")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, s.scope(t.Format("20060102")), signed, sig,
+	))
+	req.Header.Set("User-Agent", "tdi/v"+version)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errNotFound
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("s3 %s: %s %s", method, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *s3Storage) Put(name string, r io.Reader, size int64) error {
+	resp, err := s.do("PUT", s.objectURL(s.key(name)), r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3Storage) Get(name string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.objectURL(s.key(name)), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Stat(name string) (storageInfo, error) {
+	resp, err := s.do("HEAD", s.objectURL(s.key(name)), nil, 0)
+	if err != nil {
+		return storageInfo{}, err
+	}
+	resp.Body.Close()
+	mt, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return storageInfo{name, size, mt}, nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	resp, err := s.do("DELETE", s.objectURL(s.key(name)), nil, 0)
+	if err == errNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns archives directly under the prefix
+func (s *s3Storage) List() ([]storageInfo, error) {
+	prefix := ""
+	if s.Prefix != "" {
+		prefix = s.Prefix + "/"
+	}
+	var infos []storageInfo
+	token := ""
+	for {
+		u := s.objectURL("")
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		q.Set("delimiter", "/")
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = canonicalQuery(q)
+		resp, err := s.do("GET", u, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			infos = append(infos, storageInfo{strings.TrimPrefix(c.Key, prefix), c.Size, c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Presign returns a query-signed GET url of the archive
+func (s *s3Storage) Presign(name string, expire time.Duration) (string, error) {
+	return s.presignAt(name, expire, time.Now().UTC()), nil
+}
+
+func (s *s3Storage) presignAt(name string, expire time.Duration, t time.Time) string {
+	u := s.objectURL(s.key(name))
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.AccessKey+"/"+s.scope(t.Format("20060102")))
+	q.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expire.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = canonicalQuery(q)
+	headers := http.Header{}
+	headers.Set("Host", u.Host)
+	sig, _ := s.signature("GET", u, headers, unsignedPayload, t)
+	u.RawQuery += "&X-Amz-Signature=" + sig
+	return u.String()
+}
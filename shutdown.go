@@ -0,0 +1,205 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// graceful shutdown and resume of suspended jobs
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"pkg.tcw.im/gtc"
+)
+
+// suspendWait is how long suspended jobs have to stop at their next pin
+const suspendWait = 5 * time.Second
+
+func checkpointDir() string {
+	return filepath.Join(dir, ".jobs")
+}
+
+func checkpointFile(uifn string) string {
+	return filepath.Join(checkpointDir(), filepath.Base(uifn)+".json")
+}
+
+// saveCheckpoint saves the job request, so that it is resumed on next start
+func saveCheckpoint(data *download) error {
+	if err := gtc.CreateDir(checkpointDir()); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	fn := checkpointFile(data.Uifn)
+	if err := os.WriteFile(fn+".tmp", raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+func removeCheckpoint(uifn string) {
+	os.Remove(checkpointFile(uifn))
+}
+
+func runRecordFile(uifn string) string {
+	return filepath.Join(checkpointDir(), filepath.Base(uifn)+".run")
+}
+
+// saveRunRecord marks the job as running on disk, so that a clean-once run
+// in another process does not take its files as orphans
+func saveRunRecord(data *download) error {
+	if err := gtc.CreateDir(checkpointDir()); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(diskJob{data.Uifn, data.BoardId})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(runRecordFile(data.Uifn), raw, 0600)
+}
+
+func removeRunRecord(uifn string) {
+	os.Remove(runRecordFile(uifn))
+}
+
+// diskJob is the part of a checkpoint used to tell the files of a job
+type diskJob struct {
+	Uifn    string `json:"uifn"`
+	BoardId string `json:"board_id"`
+}
+
+// diskJobs returns the board ids and uifns of jobs that are running or
+// suspended by their records in the checkpoint directory, a clean-once run
+// sees them though it has no running jobs
+func diskJobs() (boards, uifns map[string]bool) {
+	boards, uifns = make(map[string]bool), make(map[string]bool)
+	dfs, err := os.ReadDir(checkpointDir())
+	if err != nil {
+		return
+	}
+	for _, f := range dfs {
+		if !strings.HasSuffix(f.Name(), ".json") && !strings.HasSuffix(f.Name(), ".run") {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(checkpointDir(), f.Name()))
+		if err != nil {
+			continue
+		}
+		var job diskJob
+		if json.Unmarshal(raw, &job) != nil {
+			continue
+		}
+		if job.BoardId != "" {
+			boards[job.BoardId] = true
+		}
+		if job.Uifn != "" {
+			uifns[job.Uifn] = true
+		}
+	}
+	return
+}
+
+// resumeJobs restarts the jobs suspended by the last shutdown, pins that
+// are already downloaded are skipped
+func resumeJobs() {
+	dfs, err := os.ReadDir(checkpointDir())
+	if err != nil {
+		return
+	}
+	// run records left by a crash are stale, their boards become orphans
+	for _, f := range dfs {
+		if strings.HasSuffix(f.Name(), ".run") {
+			os.Remove(filepath.Join(checkpointDir(), f.Name()))
+		}
+	}
+	for _, f := range dfs {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		fn := filepath.Join(checkpointDir(), f.Name())
+		raw, err := os.ReadFile(fn)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		data := &download{}
+		if err := json.Unmarshal(raw, data); err != nil {
+			log.Printf("invalid checkpoint %s: %s\n", f.Name(), err.Error())
+			os.Remove(fn)
+			continue
+		}
+		if err := data.prepare(); err != nil {
+			data.fail("resume failed: " + err.Error())
+			os.Remove(fn)
+			continue
+		}
+		log.Printf("resume download for %s\n", data.Uifn)
+		jobs.add(data)
+		go downloadBoard(data)
+	}
+}
+
+// waitShutdown blocks until SIGTERM or SIGINT, then it stops the api, waits
+// up to grace seconds for running jobs, suspends those still downloading and
+// tries to send pending callbacks
+func waitShutdown(e *echo.Echo) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	s := <-sig
+	log.Printf("received %s, shutting down\n", s)
+	cfgMu.Lock()
+	draining = true
+	cfgMu.Unlock()
+
+	deadline := time.Now().Add(time.Duration(grace) * time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	for jobs.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if n := jobs.suspend(); n > 0 {
+		log.Printf("suspend %d running jobs to resume on next start\n", n)
+	}
+	// post-processing is not safe to run twice, so jobs past downloading
+	// are waited for too, but not after suspendWait. A job killed then
+	// leaves no archive, as it is written to a part file first.
+	stop := time.Now().Add(suspendWait)
+	if stop.Before(deadline) {
+		stop = deadline
+	}
+	for jobs.count() > 0 && time.Now().Before(stop) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := jobs.count(); n > 0 {
+		log.Printf("%d jobs are not finished, exit anyway\n", n)
+	}
+	// callbacks being sent by run are claimed, so they are not sent twice,
+	// those not sent in time are kept to the next start
+	callbacks.flushUntil(stop)
+	log.Println("shutdown over")
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// archive storage backends
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+var errNotFound = errors.New("not found")
+
+type storageInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// storage keeps finished archives, names are flat file names such as Uifn
+type storage interface {
+	Put(name string, r io.Reader, size int64) error
+	Get(name string) (io.ReadCloser, error)
+	Stat(name string) (storageInfo, error)
+	Delete(name string) error
+	List() ([]storageInfo, error)
+	// Presign returns an url to download the archive within expire
+	Presign(name string, expire time.Duration) (string, error)
+}
+
+// archives is where finished archives are stored, default is local dir
+var archives storage
+
+// localStorage stores archives in a local directory, which is served by
+// sendfileView
+type localStorage struct {
+	root string
+}
+
+func (l *localStorage) path(name string) string {
+	return filepath.Join(l.root, path.Clean("/"+name))
+}
+
+func (l *localStorage) Put(name string, r io.Reader, size int64) error {
+	fn := l.path(name)
+	tmp := fn + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+func (l *localStorage) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(name))
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	}
+	return f, err
+}
+
+func (l *localStorage) Stat(name string) (storageInfo, error) {
+	fi, err := os.Stat(l.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = errNotFound
+		}
+		return storageInfo{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return storageInfo{}, errNotFound
+	}
+	return storageInfo{name, fi.Size(), fi.ModTime()}, nil
+}
+
+func (l *localStorage) Delete(name string) error {
+	err := os.Remove(l.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (l *localStorage) List() ([]storageInfo, error) {
+	dfs, err := os.ReadDir(l.root)
+	if err != nil {
+		return nil, err
+	}
+	var infos []storageInfo
+	for _, f := range dfs {
+		if !f.Type().IsRegular() {
+			continue
+		}
+		fi, err := f.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, storageInfo{f.Name(), fi.Size(), fi.ModTime()})
+	}
+	return infos, nil
+}
+
+// Presign returns the node-local path, the archive is served by sendfileView
+func (l *localStorage) Presign(name string, expire time.Duration) (string, error) {
+	return "/downloads/" + name, nil
+}
+
+// isLocalStorage reports whether archives are kept in the download dir
+func isLocalStorage() bool {
+	l, ok := archives.(*localStorage)
+	return ok && l.root == dir
+}
+
+// storeArchive moves the archive made in dir into the storage backend,
+// nothing to do for local storage
+func storeArchive(name string) error {
+	if isLocalStorage() {
+		return nil
+	}
+	fn := filepath.Join(dir, name)
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := archives.Put(name, f, fi.Size()); err != nil {
+		return err
+	}
+	return os.Remove(fn)
+}
+
+// presignExpire is the lifetime of presigned urls, as long as the archive
+// lives, etime is its expiration time or 0 if unknown
+func presignExpire(etime int64) time.Duration {
+	cfgMu.RLock()
+	expire := time.Duration(hour) * time.Hour
+	cfgMu.RUnlock()
+	if remain := etime - nowTimestamp(); etime > 0 && remain > 0 {
+		expire = time.Duration(remain) * time.Second
+	}
+	// the maximum of s3 is 7 days
+	if expire > 7*24*time.Hour {
+		expire = 7 * 24 * time.Hour
+	}
+	return expire
+}
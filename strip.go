@@ -0,0 +1,218 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// strip private metadata from jpeg and png without re-encoding
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var errBadImage = errors.New("malformed image data")
+
+// pngKeepChunks are the ancillary chunks that affect rendering,
+// critical chunks are always kept
+var pngKeepChunks = map[string]bool{
+	"tRNS": true, "gAMA": true, "cHRM": true, "sRGB": true, "iCCP": true,
+	"sBIT": true, "bKGD": true, "hIST": true, "sPLT": true, "pHYs": true,
+	"acTL": true, "fcTL": true, "fdAT": true,
+}
+
+// stripPNG drops text, time and exif chunks
+func stripPNG(raw []byte) ([]byte, error) {
+	const sig = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(raw, []byte(sig)) {
+		return nil, errBadImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(raw)))
+	out.WriteString(sig)
+	for p := len(sig); p < len(raw); {
+		if p+8 > len(raw) {
+			return nil, errBadImage
+		}
+		n := int(binary.BigEndian.Uint32(raw[p:]))
+		end := p + 12 + n // length, type, data and crc
+		if n < 0 || end > len(raw) {
+			return nil, errBadImage
+		}
+		typ := string(raw[p+4 : p+8])
+		// an uppercase first letter means a critical chunk
+		if typ[0] >= 'A' && typ[0] <= 'Z' || pngKeepChunks[typ] {
+			out.Write(raw[p:end])
+		}
+		if typ == "IEND" {
+			break
+		}
+		p = end
+	}
+	return out.Bytes(), nil
+}
+
+// exifOrientation returns the orientation tag of an exif APP1 payload,
+// 0 if there is none
+func exifOrientation(app1 []byte) uint16 {
+	if !bytes.HasPrefix(app1, []byte("Exif\x00\x00")) || len(app1) < 14 {
+		return 0
+	}
+	tiff := app1[6:]
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(bo.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if bo.Uint16(tiff[e:]) == 0x0112 {
+			return bo.Uint16(tiff[e+8:])
+		}
+	}
+	return 0
+}
+
+// orientationApp1 builds a minimal exif segment that only holds orientation,
+// so that stripped photos are still displayed the right way up
+func orientationApp1(orientation uint16) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xff, 0xe1, 0, 0})
+	b.WriteString("Exif\x00\x00")
+	b.WriteString("II*\x00")
+	binary.Write(&b, binary.LittleEndian, uint32(8))      // ifd0 offset
+	binary.Write(&b, binary.LittleEndian, uint16(1))      // entry count
+	binary.Write(&b, binary.LittleEndian, uint16(0x0112)) // tag
+	binary.Write(&b, binary.LittleEndian, uint16(3))      // type short
+	binary.Write(&b, binary.LittleEndian, uint32(1))      // count
+	binary.Write(&b, binary.LittleEndian, orientation)    // value
+	binary.Write(&b, binary.LittleEndian, uint16(0))      // padding
+	binary.Write(&b, binary.LittleEndian, uint32(0))      // next ifd
+	seg := b.Bytes()
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)-2))
+	return seg
+}
+
+// stripJPEG drops exif, xmp, iptc and comment segments before the scan data,
+// JFIF, Adobe and ICC profile segments are kept as they affect colors
+func stripJPEG(raw []byte) ([]byte, error) {
+	if len(raw) < 4 || raw[0] != 0xff || raw[1] != 0xd8 {
+		return nil, errBadImage
+	}
+	// JFIF must directly follow SOI, the kept exif is placed after it
+	var jfif []byte
+	segs := bytes.NewBuffer(make([]byte, 0, len(raw)))
+	var orientation uint16
+	for p := 2; p < len(raw); {
+		if raw[p] != 0xff || p+1 >= len(raw) {
+			return nil, errBadImage
+		}
+		marker := raw[p+1]
+		if marker == 0xff { // fill byte
+			p++
+			continue
+		}
+		// standalone markers without length
+		if marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+			segs.Write(raw[p : p+2])
+			p += 2
+			continue
+		}
+		if p+4 > len(raw) {
+			return nil, errBadImage
+		}
+		// the length includes itself, so it is at least 2
+		end := p + 2 + int(binary.BigEndian.Uint16(raw[p+2:]))
+		if end < p+4 || end > len(raw) {
+			return nil, errBadImage
+		}
+		payload := raw[p+4 : end]
+		switch {
+		case marker == 0xda: // start of scan, the rest is image data
+			out := bytes.NewBuffer(make([]byte, 0, len(raw)))
+			out.Write(raw[:2])
+			out.Write(jfif)
+			if orientation > 1 {
+				out.Write(orientationApp1(orientation))
+			}
+			out.Write(segs.Bytes())
+			out.Write(raw[p:])
+			return out.Bytes(), nil
+		case marker == 0xe0 && jfif == nil && segs.Len() == 0:
+			jfif = raw[p:end]
+		case marker == 0xe1:
+			if o := exifOrientation(payload); o > 0 {
+				orientation = o
+			}
+		case marker == 0xe2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")),
+			marker == 0xe0, marker == 0xee:
+			segs.Write(raw[p:end])
+		case marker >= 0xe0 && marker <= 0xef, marker == 0xfe:
+			// other application segments and comments are dropped
+		default:
+			segs.Write(raw[p:end])
+		}
+		p = end
+	}
+	return nil, errBadImage
+}
+
+// stripMeta removes private metadata from the jpeg and png files of the
+// manifest in place, pixels are not re-encoded
+func stripMeta(bdir string, m *manifest, readme *strbuilder) {
+	for i := range m.Files {
+		e := &m.Files[i]
+		var strip func([]byte) ([]byte, error)
+		switch e.Format {
+		case "jpeg":
+			strip = stripJPEG
+		case "png":
+			strip = stripPNG
+		default:
+			continue
+		}
+		fn := filepath.Join(bdir, e.File)
+		raw, err := os.ReadFile(fn)
+		if err == nil {
+			raw, err = strip(raw)
+		}
+		if err == nil {
+			tmp := fn + ".strip"
+			if err = os.WriteFile(tmp, raw, 0644); err == nil {
+				err = os.Rename(tmp, fn)
+			}
+		}
+		if err != nil {
+			readme.WriteS(fmt.Sprintf("strip metadata %s: %s", e.File, err.Error()))
+			continue
+		}
+		e.Size = int64(len(raw))
+		e.Stripped = true
+	}
+}
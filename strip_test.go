@@ -0,0 +1,201 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// tests of metadata stripping of untrusted jpeg and png
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func sampleImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	return img
+}
+
+func sampleJPEG(t testing.TB) []byte {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, sampleImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func samplePNG(t testing.TB) []byte {
+	var b bytes.Buffer
+	if err := png.Encode(&b, sampleImage()); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// jpegSegment builds a segment of marker with payload
+func jpegSegment(marker byte, payload string) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// pngChunk builds a chunk of typ with data
+func pngChunk(typ, data string) []byte {
+	c := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(c, uint32(len(data)))
+	c = append(c, typ...)
+	c = append(c, data...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+func TestStripMalformed(t *testing.T) {
+	const soi = "\xff\xd8"
+	const sig = "\x89PNG\r\n\x1a\n"
+	tests := []struct {
+		name  string
+		strip func([]byte) ([]byte, error)
+		raw   string
+	}{
+		{"jpeg empty", stripJPEG, ""},
+		{"jpeg soi only", stripJPEG, soi},
+		{"jpeg no marker", stripJPEG, soi + "\x00\x00\x00\x00"},
+		{"jpeg length below 2", stripJPEG, "\xff\xd8\xff0\x00\x000"},
+		{"jpeg length zero", stripJPEG, soi + "\xff\xe1\x00\x00"},
+		{"jpeg length one", stripJPEG, soi + "\xff\xe1\x00\x01"},
+		{"jpeg truncated length", stripJPEG, soi + "\xff\xe1\x00"},
+		{"jpeg truncated segment", stripJPEG, soi + "\xff\xe1\x00\x10Exif"},
+		{"jpeg no scan", stripJPEG, soi + string(jpegSegment(0xfe, "comment"))},
+		{"jpeg fill bytes only", stripJPEG, soi + "\xff\xff\xff"},
+		{"png empty", stripPNG, ""},
+		{"png bad signature", stripPNG, "\x89PNG\r\n\x1a\x00"},
+		{"png truncated header", stripPNG, sig + "\x00\x00\x00"},
+		{"png truncated chunk", stripPNG, sig + "\x00\x00\x00\x10IHDR\x00"},
+		{"png huge length", stripPNG, sig + "\xff\xff\xff\xffIHDR"},
+	}
+	for _, tt := range tests {
+		out, err := tt.strip([]byte(tt.raw))
+		if err != errBadImage {
+			t.Errorf("%s: err = %v, want errBadImage", tt.name, err)
+		}
+		if out != nil {
+			t.Errorf("%s: out = %q, want nil", tt.name, out)
+		}
+	}
+	// every prefix of a valid image is truncated, none may panic
+	for _, raw := range [][]byte{sampleJPEG(t), samplePNG(t)} {
+		for i := range raw {
+			stripJPEG(raw[:i])
+			stripPNG(raw[:i])
+		}
+	}
+}
+
+func TestStripJPEGKeepsOrientation(t *testing.T) {
+	jfif := jpegSegment(0xe0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	raw := append(append([]byte("\xff\xd8"), jfif...), sampleJPEG(t)[2:]...)
+	jfifEnd := 2 + len(jfif)
+	// exif of orientation 6, a comment and iptc after the jfif segment
+	var in bytes.Buffer
+	in.Write(raw[:jfifEnd])
+	in.Write(orientationApp1(6))
+	in.Write(jpegSegment(0xfe, "secret comment"))
+	in.Write(jpegSegment(0xed, "Photoshop 3.0\x00secret iptc"))
+	in.Write(raw[jfifEnd:])
+
+	out, err := stripJPEG(in.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("secret")) {
+		t.Error("comment or iptc is not stripped")
+	}
+	if !bytes.Equal(out[2:jfifEnd], raw[2:jfifEnd]) {
+		t.Error("jfif does not follow soi")
+	}
+	if len(out) < jfifEnd+4 || out[jfifEnd+1] != 0xe1 {
+		t.Fatal("exif is not kept after jfif")
+	}
+	n := int(binary.BigEndian.Uint16(out[jfifEnd+2:]))
+	if o := exifOrientation(out[jfifEnd+4 : jfifEnd+2+n]); o != 6 {
+		t.Errorf("orientation = %d, want 6", o)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped jpeg does not decode: %s", err)
+	}
+
+	// the default orientation needs no exif
+	in.Reset()
+	in.Write(raw[:jfifEnd])
+	in.Write(orientationApp1(1))
+	in.Write(raw[jfifEnd:])
+	out, err = stripJPEG(in.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, raw) {
+		t.Error("exif of orientation 1 is not dropped")
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	raw := samplePNG(t)
+	// text and time chunks after IHDR, gamma is kept
+	ihdrEnd := 8 + 12 + int(binary.BigEndian.Uint32(raw[8:]))
+	gama := pngChunk("gAMA", "\x00\x00\xb1\x8f")
+	var in bytes.Buffer
+	in.Write(raw[:ihdrEnd])
+	in.Write(pngChunk("tEXt", "Author\x00secret"))
+	in.Write(pngChunk("tIME", "\x07\xe6\x01\x01\x00\x00\x00"))
+	in.Write(pngChunk("eXIf", "MM\x00*secret"))
+	in.Write(gama)
+	in.Write(raw[ihdrEnd:])
+
+	out, err := stripPNG(in.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("secret")) || bytes.Contains(out, []byte("tIME")) {
+		t.Error("text, time or exif is not stripped")
+	}
+	want := append(append(append([]byte{}, raw[:ihdrEnd]...), gama...), raw[ihdrEnd:]...)
+	if !bytes.Equal(out, want) {
+		t.Error("critical or rendering chunks are changed")
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped png does not decode: %s", err)
+	}
+}
+
+func FuzzStripJPEG(f *testing.F) {
+	f.Add([]byte("\xff\xd8\xff0\x00\x000"))
+	f.Add(sampleJPEG(f))
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		stripJPEG(raw)
+	})
+}
+
+func FuzzStripPNG(f *testing.F) {
+	f.Add(samplePNG(f))
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		stripPNG(raw)
+	})
+}
@@ -0,0 +1,211 @@
+/*
+   Copyright 2021 Hiroshi.tao
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// thumbnail and contact sheet generation
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"path/filepath"
+
+	"pkg.tcw.im/gtc"
+)
+
+const (
+	thumbDir     = "thumbs"
+	thumbSize    = 240       // longest edge of a thumbnail
+	thumbQuality = 80        // jpeg quality of thumbnails and sheets
+	maxPixels    = 100000000 // refuse to decode larger images
+	sheetPadding = 4
+	maxSheetNum  = 100 // images per contact sheet, bounds its memory
+)
+
+// thumbName returns the thumbnail file name of a pin, always jpeg. The
+// source extension is kept, so a.png and a.jpg do not share a.jpg.
+func thumbName(name string) string {
+	return name + ".jpg"
+}
+
+// decodeImage decodes an image file of registered format, the size is checked
+// before decoding to avoid exhausting memory
+func decodeImage(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, errors.New("image is too large")
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// flatten draws img onto an opaque white canvas whose origin is (0, 0),
+// so transparent pixels do not turn black in the jpeg
+func flatten(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
+
+// resize scales src down so that its longest edge is no more than max,
+// each pixel is averaged over the area it covers (box filter). The source
+// rows of each output row are converted into a small strip, so a large
+// image is never copied whole, and alpha is kept for flatten.
+func resize(src image.Image, max int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > max || sh > max {
+		dw, dh = max, max
+		if sw > sh {
+			dh = sh * max / sw
+		} else {
+			dw = sw * max / sh
+		}
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	strip := image.NewRGBA(image.Rect(0, 0, sw, (sh+dh-1)/dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		if y1 == y0 {
+			y1++
+		}
+		draw.Draw(strip, image.Rect(0, 0, sw, y1-y0), src, image.Pt(b.Min.X, b.Min.Y+y0), draw.Src)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			if x1 == x0 {
+				x1++
+			}
+			var sum [4]uint64
+			for sy := 0; sy < y1-y0; sy++ {
+				i := strip.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					sum[0] += uint64(strip.Pix[i])
+					sum[1] += uint64(strip.Pix[i+1])
+					sum[2] += uint64(strip.Pix[i+2])
+					sum[3] += uint64(strip.Pix[i+3])
+					i += 4
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			j := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[j+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+func saveJPEG(filename string, img image.Image) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return jpeg.Encode(f, img, &jpeg.Options{Quality: thumbQuality})
+}
+
+// contactSheet lays thumbnails out in a square-ish grid
+func contactSheet(thumbs []*image.RGBA) *image.RGBA {
+	cols := int(math.Ceil(math.Sqrt(float64(len(thumbs)))))
+	rows := (len(thumbs) + cols - 1) / cols
+	cell := thumbSize + sheetPadding*2
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*cell, rows*cell))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+	for i, t := range thumbs {
+		x := (i%cols)*cell + (cell-t.Rect.Dx())/2
+		y := (i/cols)*cell + (cell-t.Rect.Dy())/2
+		r := image.Rect(x, y, x+t.Rect.Dx(), y+t.Rect.Dy())
+		draw.Draw(sheet, r, t, image.Point{}, draw.Src)
+	}
+	return sheet
+}
+
+// makeThumbs generates thumbnails into the thumbs folder of the board
+// directory and, if sheetNum > 0, a contact sheet for every sheetNum images.
+// It pauses while the system is busy and gives up if it stays busy.
+func makeThumbs(bdir string, files []manifestEntry, saveThumbs bool, sheetNum int, readme *strbuilder) {
+	if saveThumbs {
+		if err := gtc.CreateDir(filepath.Join(bdir, thumbDir)); err != nil {
+			readme.WriteE(err)
+			return
+		}
+	}
+	var sheet []*image.RGBA
+	var sheetNo int
+	flush := func() {
+		if len(sheet) == 0 {
+			return
+		}
+		sheetNo++
+		name := fmt.Sprintf("contact_sheet_%03d.jpg", sheetNo)
+		if err := saveJPEG(filepath.Join(bdir, name), contactSheet(sheet)); err != nil {
+			readme.WriteS(fmt.Sprintf("contact sheet %s: %s", name, err.Error()))
+		}
+		sheet = sheet[:0]
+	}
+	for _, e := range files {
+		if !waitIdle() {
+			readme.WriteS("system is busy, thumbnail generation aborted")
+			break
+		}
+		img, err := decodeImage(filepath.Join(bdir, e.File))
+		if err != nil {
+			readme.WriteS(fmt.Sprintf("thumbnail %s: %s", e.File, err.Error()))
+			continue
+		}
+		t := flatten(resize(img, thumbSize))
+		if saveThumbs {
+			err = saveJPEG(filepath.Join(bdir, thumbDir, thumbName(e.File)), t)
+			if err != nil {
+				readme.WriteS(fmt.Sprintf("thumbnail %s: %s", e.File, err.Error()))
+			}
+		}
+		if sheetNum > 0 {
+			sheet = append(sheet, t)
+			if len(sheet) >= sheetNum {
+				flush()
+			}
+		}
+	}
+	flush()
+}
@@ -59,6 +59,17 @@ func diskRate(volumePath string) (percent float64, err error) {
 	return strconv.ParseFloat(fmt.Sprintf("%.2f", obj.UsedPercent), 64)
 }
 
+// diskOverBytes returns how many bytes need to be freed to bring the usage
+// of the disk where the directory is located down to limit percent
+func diskOverBytes(volumePath string, limit float64) (int64, error) {
+	obj, err := disk.Usage(volumePath)
+	if err != nil {
+		return 0, err
+	}
+	allow := float64(obj.Used+obj.Free) * limit / 100
+	return int64(float64(obj.Used) - allow), nil
+}
+
 // memRate returns system memory usage
 func memRate() (percent float64, err error) {
 	obj, e := mem.VirtualMemory()
@@ -80,24 +91,50 @@ func loadStat() (loadavg5 float64, err error) {
 	return
 }
 
+// systemBusy reports whether memory usage or load exceeds the limits
+func systemBusy() bool {
+	cfgMu.RLock()
+	maxMem, maxLoad := memLimit, loadLimit
+	cfgMu.RUnlock()
+	if mp, err := memRate(); err == nil && mp > maxMem {
+		return true
+	}
+	if load5, err := loadStat(); err == nil && load5 > maxLoad {
+		return true
+	}
+	return false
+}
+
+// waitIdle waits up to half a minute for the system to be idle
+func waitIdle() bool {
+	for i := 0; i < 6; i++ {
+		if !systemBusy() {
+			return true
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return false
+}
+
 // makeTarFile compress all files in a directory.
 // Automatically delete after compression.
 func makeTarFile(tarFilename, tarPath string, exclude []string) (err error) {
 	if !strings.HasSuffix(tarFilename, ".tar") || !gtc.IsDir(tarPath) {
 		return errors.New("make tar: invalid param")
 	}
-	fw, err := os.Create(tarFilename)
+	// write to a part file first, so that a killed process does not leave
+	// a truncated archive
+	part := tarFilename + ".part"
+	fw, err := os.Create(part)
 	if err != nil {
 		return
 	}
-	defer fw.Close()
 
 	// create Tar.Writer structure
 	tw := tar.NewWriter(fw)
-	defer tw.Close()
 
 	// Recursively process all files in the directory
-	return filepath.Walk(tarPath, func(fileName string, fi os.FileInfo, err error) error {
+	err = filepath.Walk(tarPath, func(fileName string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -114,6 +151,12 @@ func makeTarFile(tarFilename, tarPath string, exclude []string) (err error) {
 		if err != nil {
 			return err
 		}
+		// keep the path relative to tarPath, such as thumbs/xxx.png.jpg
+		rel, err := filepath.Rel(tarPath, fileName)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
 		// write file information
 		if err := tw.WriteHeader(hdr); err != nil {
 			return err
@@ -123,13 +166,24 @@ func makeTarFile(tarFilename, tarPath string, exclude []string) (err error) {
 			return err
 		}
 		_, err = io.Copy(tw, fr)
+		fr.Close()
 		if err != nil {
 			return err
 		}
-		fr.Close()
 		os.Remove(fileName)
 		return nil
 	})
+	if cerr := tw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := fw.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(part)
+		return
+	}
+	return os.Rename(part, tarFilename)
 }
 
 // formatSize format byte size as kilobytes, megabytes, gigabytes
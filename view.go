@@ -18,12 +18,13 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"path"
 	"path/filepath"
 	"runtime"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -49,7 +50,7 @@ func pingView(c echo.Context) error {
 	info := make(map[string]interface{})
 	info["code"] = 0
 	info["version"] = version
-	info["status"] = status
+	info["status"] = serviceStatus()
 	info["memRate"] = memp
 	info["diskRate"] = diskp
 	info["loadFive"] = load5
@@ -96,19 +97,34 @@ func downloadView(c echo.Context) error {
 		return errors.New("invalid param")
 	}
 
-	pins := make([]pin, 0)
-	json.Unmarshal([]byte(data.BoardPins), &pins)
-	if len(pins) < 1 {
-		return errors.New("empty download")
+	if err := data.prepare(); err != nil {
+		return err
+	}
+	if ae := admit(data); ae != nil && ae.code == codeRunning {
+		// the same request again, such as a retry after a lost response
+		log.Printf("download for %s is running, request ignored\n", data.Uifn)
+		return c.JSONBlob(201, []byte(`{"code":0,"msg":"downloading"}`))
+	} else if ae != nil {
+		log.Printf("refuse download for %s: %s\n", data.Uifn, ae.msg)
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(ae.retry.Seconds())))
+		return c.JSON(503, eres{ae.code, ae.msg})
 	}
-	data.downloads = pins
 
 	// write to temp file
-	simple := clean{data.Uifn, data.CallbackURL}
+	simple := clean{
+		Uifn:        data.Uifn,
+		UifnKey:     data.UifnKey,
+		CallbackURL: data.CallbackURL,
+		Etime:       unixSeconds(data.Etime),
+		Events:      data.CallbackEvents,
+		JSON:        data.CallbackJSON,
+	}
 	if err := serialize(simple, data.Uifn); err != nil {
+		jobs.remove(data.Uifn, false)
 		return err
 	}
 
+	data.event(actionAccepted, map[string]string{"pins": fmt.Sprintf("%d", len(data.downloads))})
 	go downloadBoard(data)
 
 	return c.JSONBlob(201, []byte(`{"code":0,"msg":"downloading"}`))
@@ -116,12 +132,156 @@ func downloadView(c echo.Context) error {
 
 func sendfileView(c echo.Context) error {
 	name := c.Param("filename")
-	if name == "" || !strings.HasPrefix(name, "hb_") {
+	if _, _, ok := parseUifn(name); !ok {
 		return c.String(400, "illegal filename")
 	}
-	f := filepath.Join(dir, path.Clean(name))
+	name = path.Base(path.Clean("/" + name))
+	if !isLocalStorage() {
+		if _, err := archives.Stat(name); err != nil {
+			return c.String(404, "not found")
+		}
+		u, err := archives.Presign(name, presignExpire(archiveEtime(name)))
+		if err != nil {
+			return err
+		}
+		touchArchive(name)
+		return c.Redirect(302, u)
+	}
+	f := filepath.Join(dir, name)
 	if !gtc.IsFile(f) {
 		return c.String(404, "not found")
 	}
+	touchArchive(name)
+	cfgMu.RLock()
+	connBW := newBandwidth(connUploadLimit)
+	cfgMu.RUnlock()
+	c.Response().Writer = &limitedWriter{c.Response().Writer, []*bandwidth{uploadBW, connBW}}
 	return c.Attachment(f, name)
 }
+
+func cancelView(c echo.Context) error {
+	if err := signatureRequired(c); err != nil {
+		return err
+	}
+	uifn := c.FormValue("uifn")
+	if uifn == "" {
+		return errors.New("invalid param")
+	}
+	if !jobs.cancel(uifn) {
+		return c.JSON(404, eres{-1, "no such job"})
+	}
+	return c.JSON(200, eres{0, "cancelling"})
+}
+
+func callbacksView(c echo.Context) error {
+	if err := signatureRequired(c); err != nil {
+		return err
+	}
+	state := c.QueryParam("state")
+	if state == "" {
+		state = "dead"
+	}
+	if state != "pending" && state != "dead" {
+		return errors.New("invalid state")
+	}
+	cbs, err := callbacks.list(state)
+	if err != nil {
+		return err
+	}
+	info := make(map[string]interface{})
+	info["code"] = 0
+	info["state"] = state
+	info["callbacks"] = cbs
+	return c.JSON(200, info)
+}
+
+func replayCallbackView(c echo.Context) error {
+	if err := signatureRequired(c); err != nil {
+		return err
+	}
+	// replay all dead callbacks if id is empty
+	n, err := callbacks.replay(c.FormValue("id"))
+	if err != nil {
+		return err
+	}
+	info := make(map[string]interface{})
+	info["code"] = 0
+	info["replayed"] = n
+	return c.JSON(200, info)
+}
+
+// serviceStatus is the status reported to the central node, a draining
+// service is tardy so that no new boards are routed to it
+func serviceStatus() string {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	if draining {
+		return "tardy"
+	}
+	return status
+}
+
+type jobInfo struct {
+	Uifn    string `json:"uifn"`
+	BoardId string `json:"board_id"`
+	Done    int32  `json:"done"`
+	Total   int32  `json:"total"`
+}
+
+func adminStatusView(c echo.Context) error {
+	if err := signatureRequired(c); err != nil {
+		return err
+	}
+	running := make([]jobInfo, 0)
+	for _, data := range jobs.list() {
+		running = append(running, jobInfo{data.Uifn, data.BoardId, data.done.Load(), data.total.Load()})
+	}
+	cfgMu.RLock()
+	st, drain := status, draining
+	cfgMu.RUnlock()
+	info := make(map[string]interface{})
+	info["code"] = 0
+	info["status"] = st
+	info["draining"] = drain
+	info["jobs"] = len(running)
+	info["running"] = running
+	// drained means it is safe to stop the service
+	info["drained"] = drain && len(running) == 0
+	return c.JSON(200, info)
+}
+
+func setStatusView(c echo.Context) error {
+	if err := signatureRequired(c); err != nil {
+		return err
+	}
+	st := c.FormValue("status")
+	if st != "ready" && st != "tardy" {
+		return errors.New("status needs to be ready or tardy")
+	}
+	cfgMu.Lock()
+	status = st
+	adminStatus = true
+	cfgMu.Unlock()
+	log.Printf("service status is set to %s\n", st)
+	return c.JSON(200, eres{0, st})
+}
+
+func drainView(c echo.Context) error {
+	if err := signatureRequired(c); err != nil {
+		return err
+	}
+	v := c.FormValue("drain")
+	if v == "" {
+		return errors.New("invalid param")
+	}
+	on := gtc.IsTrue(v)
+	cfgMu.Lock()
+	draining = on
+	cfgMu.Unlock()
+	if on {
+		log.Printf("drain mode on, %d jobs running\n", jobs.count())
+		return c.JSON(200, eres{0, "draining"})
+	}
+	log.Println("drain mode off")
+	return c.JSON(200, eres{0, "accepting"})
+}
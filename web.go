@@ -18,11 +18,18 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -40,11 +47,69 @@ type download struct {
 	MAXBoardNumber uint    `json:"MAX_BOARD_NUMBER"`
 	CallbackURL    string  `json:"CALLBACK_URL"`
 	DiskLimit      float64 `json:"DISKLIMIT"`
+	BoardTitle     string  `json:"board_title"`
+	Gallery        bool    `json:"gallery"`         // bundle index.html in archive
+	Thumbs         bool    `json:"thumbs"`          // generate thumbnails
+	ContactSheet   uint    `json:"contact_sheet"`   // images per contact sheet up to 100, 0 is off
+	Convert        string  `json:"convert"`         // convert webp etc. to jpeg or png
+	KeepOriginal   bool    `json:"keep_original"`   // keep original files if convert
+	StripMeta      bool    `json:"strip_meta"`      // remove exif and other metadata
+	Dedup          string  `json:"dedup"`           // drop or group similar images
+	Delivery       string  `json:"delivery"`        // json of delivery target
+	CallbackEvents bool    `json:"callback_events"` // send lifecycle callbacks
+	CallbackJSON   bool    `json:"callback_json"`   // post callbacks as json
+	deliver        *delivery
+	cancelled      atomic.Bool
+	suspended      atomic.Bool  // stopped by shutdown, resumed on next start
+	finishing      atomic.Bool  // past downloading, not suspended any more
+	done           atomic.Int32 // pins processed
+	total          atomic.Int32 // pins to download
 }
 
 type clean struct {
 	Uifn        string `json:"uifn"`
+	UifnKey     string `json:"uifnKey"`
 	CallbackURL string `json:"CALLBACK_URL"`
+	Atime       int64  `json:"atime"`  // last downloaded by user
+	Etime       int64  `json:"etime"`  // expiration time of the job
+	Events      bool   `json:"events"` // send lifecycle callbacks
+	JSON        bool   `json:"json"`   // post callbacks as json
+}
+
+// prepare checks the options of the job and parses its pins
+func (data *download) prepare() error {
+	var err error
+	data.Convert, err = convertTarget(data.Convert)
+	if err != nil {
+		return err
+	}
+	data.Dedup, err = dedupMode(data.Dedup)
+	if err != nil {
+		return err
+	}
+	data.deliver, err = parseDelivery(data.Delivery)
+	if err != nil {
+		return err
+	}
+	if data.ContactSheet > maxSheetNum {
+		return fmt.Errorf("contact_sheet needs to be at most %d", maxSheetNum)
+	}
+
+	pins := make([]pin, 0)
+	json.Unmarshal([]byte(data.BoardPins), &pins)
+	if len(pins) < 1 {
+		return errors.New("empty download")
+	}
+	data.downloads = pins
+	return nil
+}
+
+// unixSeconds accepts a timestamp in seconds or milliseconds
+func unixSeconds(ts uint) int64 {
+	if ts > 1e12 {
+		return int64(ts / 1000)
+	}
+	return int64(ts)
 }
 
 type pin struct {
@@ -122,14 +187,16 @@ func checkTimestamp(reqTimestamp string) error {
 }
 
 func checkSignature(signature, timestamp, nonce string) bool {
+	cfgMu.RLock()
 	args := []string{token, timestamp, nonce}
+	cfgMu.RUnlock()
 	sort.Strings(args)
 	mysig := SHA1(strings.Join(args, ""))
 	return mysig == signature
 }
 
-func httpGet(url string, headers map[string]string, timeout time.Duration) (resp *http.Response, err error) {
-	var client = &http.Client{Timeout: timeout}
+func httpGet(site uint8, url string, headers map[string]string, timeout time.Duration) (resp *http.Response, err error) {
+	var client = pinClient(site, timeout)
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -143,21 +210,77 @@ func httpGet(url string, headers map[string]string, timeout time.Duration) (resp
 	return client.Do(req)
 }
 
-func httpPost(url string, data map[string]string) (resp *http.Response, err error) {
-	var post http.Request
-	post.ParseForm()
-	for k, v := range data {
-		post.Form.Add(k, v)
+func httpHead(site uint8, url string, headers map[string]string, timeout time.Duration) (resp *http.Response, err error) {
+	var client = pinClient(site, timeout)
+
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return
+	}
+
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+
+	return client.Do(req)
+}
+
+// callbackSignature signs outbound callbacks like checkSignature, but the
+// Action query and form (or json) body are included, so that an event can
+// not be turned into another one with the same body, and HMAC-SHA256 is
+// keyed by token
+func callbackSignature(timestamp, nonce, action, body string) string {
+	args := []string{timestamp, nonce, action, body}
+	sort.Strings(args)
+	cfgMu.RLock()
+	mac := hmac.New(sha256.New, []byte(token))
+	cfgMu.RUnlock()
+	mac.Write([]byte(strings.Join(args, "")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// httpPost posts form data (or json if asJSON) to the callback api, the query
+// string is added with timestamp, nonce and signature so the receiver can
+// verify it
+func httpPost(api string, data map[string]string, asJSON bool) (resp *http.Response, err error) {
+	var body string
+	contentType := "application/x-www-form-urlencoded"
+	if asJSON {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		body = string(raw)
+		contentType = "application/json"
+	} else {
+		var post http.Request
+		post.ParseForm()
+		for k, v := range data {
+			post.Form.Add(k, v)
+		}
+		body = post.Form.Encode()
+	}
+
+	u, err := url.Parse(api)
+	if err != nil {
+		return
 	}
+	timestamp := strconv.FormatInt(nowTimestamp(), 10)
+	nonce := genRandomString(16)
+	q := u.Query()
+	q.Set("timestamp", timestamp)
+	q.Set("nonce", nonce)
+	q.Set("signature", callbackSignature(timestamp, nonce, q.Get("Action"), body))
+	u.RawQuery = q.Encode()
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest(
-		"POST", url, strings.NewReader(post.Form.Encode()),
-	)
+	cfgMu.RLock()
+	client := &http.Client{Transport: directTransport, Timeout: time.Duration(callbackTimeout) * time.Second}
+	cfgMu.RUnlock()
+	req, err := http.NewRequest("POST", u.String(), strings.NewReader(body))
 	if err != nil {
 		return
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("User-Agent", "tdi/v"+version)
 
 	return client.Do(req)